@@ -0,0 +1,88 @@
+// Package balancer exposes the balancing algorithms registry used by minibalancer groups.
+// A custom algorithm is registered by name, usually from an init function, and is then
+// selected by the "algorithm" field of a group:
+//
+//	func init() {
+//		balancer.Register("tenant", func() balancer.Balancer { return &tenantBalancer{} })
+//	}
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var ErrNoEndpoint = errors.New("all endpoints down")
+
+// Endpoint is the view of a backend given to a Balancer.
+type Endpoint interface {
+	// Addr is the configured endpoint address.
+	Addr() string
+	// InFlight is the number of requests currently proxied to the endpoint.
+	InFlight() uint64
+	// EffectiveWeight is the configured weight, reduced during slow start.
+	EffectiveWeight() float64
+}
+
+// Balancer chooses an endpoint for a request.
+type Balancer interface {
+	// Balance receives only healthy endpoints (alive, not draining, not ejected), never an empty slice,
+	// and must return one of them. r is nil when the traffic is not HTTP.
+	Balance(r *http.Request, endpoints []Endpoint) (Endpoint, error)
+}
+
+// Factory creates the Balancer of a single group, so that state is never shared between groups.
+type Factory func() Balancer
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes an algorithm available by name (case insensitive).
+// It panics if the name is empty, already registered or the factory is nil.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	name = strings.ToLower(name)
+	if name == "" {
+		panic("balancer: Register with empty name")
+	}
+	if factory == nil {
+		panic("balancer: Register factory is nil for " + name)
+	}
+	if _, dup := registry[name]; dup {
+		panic("balancer: Register called twice for " + name)
+	}
+	registry[name] = factory
+}
+
+// New creates the Balancer registered with name.
+func New(name string) (Balancer, error) {
+	registryMu.RLock()
+	factory, ok := registry[strings.ToLower(name)]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown balancing algorithm %q", name)
+	}
+	return factory(), nil
+}
+
+// Names returns the sorted names of the registered algorithms.
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
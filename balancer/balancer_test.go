@@ -0,0 +1,65 @@
+package balancer
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+type first struct{}
+
+func (first) Balance(_ *http.Request, endpoints []Endpoint) (Endpoint, error) {
+	return endpoints[0], nil
+}
+
+// stateful balancer, every New call must return its own
+type counter struct {
+	first
+	n int
+}
+
+// registered once, the registry is process wide and tests can run several times
+func init() {
+	Register("Test-First", func() Balancer { return first{} })
+	Register("test-counter", func() Balancer { return &counter{} })
+}
+
+func expectPanic(t *testing.T, name string, f func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("%s did not panic", name)
+		}
+	}()
+	f()
+}
+
+func TestRegister(t *testing.T) {
+	b, err := New("test-FIRST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.(first); !ok {
+		t.Errorf("New returned %T", b)
+	}
+	if !slices.Contains(Names(), "test-first") || !slices.IsSorted(Names()) {
+		t.Errorf("names = %v", Names())
+	}
+
+	factory := func() Balancer { return first{} }
+	expectPanic(t, "duplicate name", func() { Register("TEST-first", factory) })
+	expectPanic(t, "empty name", func() { Register("", factory) })
+	expectPanic(t, "nil factory", func() { Register("test-nil", nil) })
+
+	if _, err := New("test-unknown"); err == nil {
+		t.Error("unknown algorithm resolved")
+	}
+}
+
+func TestFactoryPerGroup(t *testing.T) {
+	a, _ := New("test-counter")
+	b, _ := New("test-counter")
+	if a == b {
+		t.Error("balancer state shared between two New calls")
+	}
+}
@@ -0,0 +1,384 @@
+package internal
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	STICKY_COOKIE    = "cookie"
+	STICKY_SOURCE_IP = "sourceip"
+	STICKY_LEARN     = "learn"
+
+	//what happens when the sticky endpoint cannot serve the session anymore
+	FAILOVER_REBALANCE           = "rebalance"
+	FAILOVER_STRICT              = "strict"
+	FAILOVER_RETURN_WHEN_HEALTHY = "return-when-healthy"
+
+	DefaultStickyTableSize int           = 10000
+	DefaultStickyTTL       time.Duration = 30 * time.Minute
+	DefaultMigrationHeader string        = "X-Session-Migrated"
+
+	//suffix of the cookie pinning the temporary endpoint in return-when-healthy mode
+	fallbackCookieSuffix = "_fb"
+)
+
+type Stickiness struct {
+	//cookie (balancer injected cookie), sourceIP or learn (application cookie set by the endpoint)
+	Mode string `json:"mode"`
+	//sourceIP and learn modes keep an in memory table, least recently used entries are evicted
+	TableSize int    `json:"tableSize,omitempty"`
+	TTL       string `json:"ttl,omitempty"`
+	//name of the application cookie pinned in learn mode, e.g. JSESSIONID
+	LearnCookie string `json:"learnCookie,omitempty"`
+	//attributes of the balancer injected cookie in cookie mode
+	Cookie *SessionCookie `json:"cookie,omitempty"`
+	//rebalance (default), strict or return-when-healthy. strict keeps failing the session
+	//while its endpoint is down, but a drained endpoint is gone on purpose: its sessions
+	//are rebalanced whatever the policy
+	FailoverPolicy string `json:"failoverPolicy,omitempty"`
+	//set on the request to the new endpoint and on the response when a session is migrated,
+	//"-" disables it
+	MigrationHeader string `json:"migrationHeader,omitempty"`
+}
+
+// strategy used by a group to keep a client on the same endpoint
+type sessionAffinity interface {
+	get(r *http.Request, endpoints []*Endpoint) (*Endpoint, error)
+	set(w http.ResponseWriter, r *http.Request, endpoint *Endpoint)
+	//temporary endpoint of the session while the sticky one is down, used by return-when-healthy
+	getFallback(r *http.Request, endpoints []*Endpoint) *Endpoint
+	//nil removes the temporary endpoint
+	setFallback(w http.ResponseWriter, r *http.Request, endpoint *Endpoint)
+}
+
+func (group *Group) initAffinity() error {
+	sticky := group.Stickiness
+	if sticky == nil {
+		group.failoverPolicy = FAILOVER_REBALANCE
+		group.migrationHeader = DefaultMigrationHeader
+		if group.SessionPersistence {
+			return group.initCookieAffinity()
+		}
+		return nil
+	}
+
+	switch policy := strings.ToLower(sticky.FailoverPolicy); policy {
+	case "":
+		group.failoverPolicy = FAILOVER_REBALANCE
+	case FAILOVER_REBALANCE, FAILOVER_STRICT, FAILOVER_RETURN_WHEN_HEALTHY:
+		group.failoverPolicy = policy
+	default:
+		return fmt.Errorf("unknown sticky failover policy %q", sticky.FailoverPolicy)
+	}
+
+	switch sticky.MigrationHeader {
+	case "":
+		group.migrationHeader = DefaultMigrationHeader
+	case "-":
+		group.migrationHeader = ""
+	default:
+		group.migrationHeader = sticky.MigrationHeader
+	}
+
+	if sticky.TableSize < 0 {
+		return fmt.Errorf("invalid stickiness tableSize %d", sticky.TableSize)
+	}
+	ttl := getWithDefaultDuration(sticky.TTL, DefaultStickyTTL)
+	size := getWithDefaultInt(sticky.TableSize, DefaultStickyTableSize)
+
+	switch strings.ToLower(sticky.Mode) {
+	case STICKY_COOKIE:
+		return group.initCookieAffinity()
+	case STICKY_SOURCE_IP:
+		group.affinity = &sourceIPAffinity{table: newAffinityTable(size, ttl)}
+	case STICKY_LEARN:
+		if sticky.LearnCookie == "" {
+			return errors.New("learn stickiness requires learnCookie")
+		}
+		group.affinity = &learnAffinity{cookieName: sticky.LearnCookie, table: newAffinityTable(size, ttl)}
+	default:
+		return fmt.Errorf("unknown stickiness mode %q", sticky.Mode)
+	}
+	return nil
+}
+
+func (group *Group) initCookieAffinity() error {
+	session := &group.conf.Settings.PersistentSession
+	cookie, err := newSessionCookie(group, session)
+	if err != nil {
+		return err
+	}
+
+	fallback := *cookie
+	fallback.name += fallbackCookieSuffix
+
+	group.affinity = &cookieAffinity{session: session, cookie: cookie, fallback: &fallback}
+	return nil
+}
+
+// policy applied to a session whose endpoint cannot serve it, strict sessions of a
+// drained endpoint are rebalanced since the endpoint is not coming back
+func (group *Group) sessionFailoverPolicy(from *Endpoint) string {
+	if group.failoverPolicy == FAILOVER_STRICT && from.drained.Load() {
+		return FAILOVER_REBALANCE
+	}
+	return group.failoverPolicy
+}
+
+// the sticky endpoint cannot serve the session, the policy of the group decides
+// whether it is moved to another endpoint
+func (group *Group) migrateSession(w http.ResponseWriter, r *http.Request, from *Endpoint) (*Endpoint, error) {
+	var to *Endpoint
+	var e error
+
+	policy := group.sessionFailoverPolicy(from)
+	switch policy {
+	case FAILOVER_STRICT:
+		slog.Info("session endpoint not available, strict failover policy", "group", group.Path, "endpoint", from.Address)
+		return nil, errors.New("sticky endpoint not available")
+	case FAILOVER_RETURN_WHEN_HEALTHY:
+		//already migrated by a previous request
+		if to = group.affinity.getFallback(r, group.Endpoints); to != nil && to.acceptsSession() {
+			return to, nil
+		}
+
+		to, e = group.getBalancedEndpoint(r, group.Endpoints)
+		if e != nil {
+			return nil, e
+		}
+		group.affinity.setFallback(w, r, to)
+	default:
+		to, e = group.getBalancedEndpoint(r, group.Endpoints)
+		if e != nil {
+			return nil, e
+		}
+		group.affinity.set(w, r, to)
+	}
+
+	slog.Info("session migrated", "group", group.Path, "from", from.Address, "to", to.Address, "policy", policy)
+	if group.migrationHeader != "" {
+		r.Header.Set(group.migrationHeader, "true")
+		w.Header().Set(group.migrationHeader, "true")
+	}
+	return to, nil
+}
+
+// balancer injected cookie, see StatelessSessionPersistence
+type cookieAffinity struct {
+	session  *StatelessSessionPersistence
+	cookie   *sessionCookie
+	fallback *sessionCookie
+}
+
+func (c *cookieAffinity) get(r *http.Request, endpoints []*Endpoint) (*Endpoint, error) {
+	return c.session.get(r, c.cookie, endpoints)
+}
+
+func (c *cookieAffinity) set(w http.ResponseWriter, r *http.Request, endpoint *Endpoint) {
+	c.session.setCookie(w, r, c.cookie, endpoint)
+}
+
+func (c *cookieAffinity) getFallback(r *http.Request, endpoints []*Endpoint) *Endpoint {
+	endpoint, err := c.session.get(r, c.fallback, endpoints)
+	if err != nil {
+		return nil
+	}
+	return endpoint
+}
+
+func (c *cookieAffinity) setFallback(w http.ResponseWriter, r *http.Request, endpoint *Endpoint) {
+	if endpoint != nil {
+		c.session.setCookie(w, r, c.fallback, endpoint)
+		return
+	}
+
+	expired := c.fallback.build(r, "")
+	expired.MaxAge = -1
+	http.SetCookie(w, expired)
+}
+
+type sourceIPAffinity struct {
+	table *affinityTable
+}
+
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (s *sourceIPAffinity) get(r *http.Request, _ []*Endpoint) (*Endpoint, error) {
+	return s.table.get(sourceIP(r))
+}
+
+func (s *sourceIPAffinity) set(_ http.ResponseWriter, r *http.Request, endpoint *Endpoint) {
+	s.table.put(sourceIP(r), endpoint)
+}
+
+func (s *sourceIPAffinity) getFallback(r *http.Request, _ []*Endpoint) *Endpoint {
+	return s.table.getFallback(sourceIP(r))
+}
+
+func (s *sourceIPAffinity) setFallback(_ http.ResponseWriter, r *http.Request, endpoint *Endpoint) {
+	s.table.setFallback(sourceIP(r), endpoint)
+}
+
+// pins the application cookie value to the endpoint which issued it
+type learnAffinity struct {
+	cookieName string
+	table      *affinityTable
+}
+
+func (l *learnAffinity) get(r *http.Request, _ []*Endpoint) (*Endpoint, error) {
+	c, err := r.Cookie(l.cookieName)
+	if err != nil || c.Value == "" {
+		return nil, errors.New("no application session cookie found")
+	}
+	return l.table.get(c.Value)
+}
+
+// a new session value is not known until the endpoint answers (see learn),
+// an existing one is moved to the new endpoint
+func (l *learnAffinity) set(_ http.ResponseWriter, r *http.Request, endpoint *Endpoint) {
+	if c, err := r.Cookie(l.cookieName); err == nil && c.Value != "" {
+		l.table.put(c.Value, endpoint)
+	}
+}
+
+func (l *learnAffinity) getFallback(r *http.Request, _ []*Endpoint) *Endpoint {
+	c, err := r.Cookie(l.cookieName)
+	if err != nil {
+		return nil
+	}
+	return l.table.getFallback(c.Value)
+}
+
+func (l *learnAffinity) setFallback(_ http.ResponseWriter, r *http.Request, endpoint *Endpoint) {
+	if c, err := r.Cookie(l.cookieName); err == nil {
+		l.table.setFallback(c.Value, endpoint)
+	}
+}
+
+// used as part of ReverseProxy.ModifyResponse
+func (l *learnAffinity) learn(resp *http.Response, endpoint *Endpoint) {
+	for _, c := range resp.Cookies() {
+		if c.Name != l.cookieName {
+			continue
+		}
+
+		if c.Value == "" || c.MaxAge < 0 {
+			if old, err := resp.Request.Cookie(l.cookieName); err == nil {
+				l.table.remove(old.Value)
+			}
+			continue
+		}
+		l.table.put(c.Value, endpoint)
+	}
+}
+
+type affinityEntry struct {
+	key      string
+	endpoint *Endpoint
+	fallback *Endpoint
+	expiry   time.Time
+}
+
+// bounded LRU table, entries expire ttl after their last use
+type affinityTable struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func newAffinityTable(size int, ttl time.Duration) *affinityTable {
+	return &affinityTable{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+func (t *affinityTable) get(key string) (*Endpoint, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	element, ok := t.entries[key]
+	if !ok {
+		return nil, errors.New("no session found")
+	}
+
+	entry := element.Value.(*affinityEntry)
+	if time.Now().After(entry.expiry) {
+		t.lru.Remove(element)
+		delete(t.entries, key)
+		return nil, errors.New("session expired")
+	}
+
+	entry.expiry = time.Now().Add(t.ttl)
+	t.lru.MoveToFront(element)
+	return entry.endpoint, nil
+}
+
+func (t *affinityTable) put(key string, endpoint *Endpoint) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if element, ok := t.entries[key]; ok {
+		entry := element.Value.(*affinityEntry)
+		entry.endpoint = endpoint
+		entry.fallback = nil
+		entry.expiry = time.Now().Add(t.ttl)
+		t.lru.MoveToFront(element)
+		return
+	}
+
+	for t.lru.Len() >= t.size {
+		oldest := t.lru.Back()
+		t.lru.Remove(oldest)
+		delete(t.entries, oldest.Value.(*affinityEntry).key)
+	}
+
+	t.entries[key] = t.lru.PushFront(&affinityEntry{key: key, endpoint: endpoint, expiry: time.Now().Add(t.ttl)})
+}
+
+func (t *affinityTable) getFallback(key string) *Endpoint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if element, ok := t.entries[key]; ok {
+		return element.Value.(*affinityEntry).fallback
+	}
+	return nil
+}
+
+func (t *affinityTable) setFallback(key string, endpoint *Endpoint) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if element, ok := t.entries[key]; ok {
+		element.Value.(*affinityEntry).fallback = endpoint
+	}
+}
+
+func (t *affinityTable) remove(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if element, ok := t.entries[key]; ok {
+		t.lru.Remove(element)
+		delete(t.entries, key)
+	}
+}
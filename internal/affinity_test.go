@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAffinityTableEviction(t *testing.T) {
+	a, b := &Endpoint{Address: "a"}, &Endpoint{Address: "b"}
+	table := newAffinityTable(2, time.Minute)
+
+	table.put("1", a)
+	table.put("2", b)
+	//1 becomes the most recently used, 2 is evicted by 3
+	if got, _ := table.get("1"); got != a {
+		t.Fatalf("get(1) = %v", got)
+	}
+	table.put("3", b)
+
+	if _, err := table.get("2"); err == nil {
+		t.Error("the least recently used entry was not evicted")
+	}
+	for _, key := range []string{"1", "3"} {
+		if _, err := table.get(key); err != nil {
+			t.Errorf("entry %s evicted: %v", key, err)
+		}
+	}
+	if table.lru.Len() != 2 || len(table.entries) != 2 {
+		t.Errorf("table holds %d entries, want 2", table.lru.Len())
+	}
+}
+
+func TestAffinityTableExpiry(t *testing.T) {
+	a := &Endpoint{Address: "a"}
+	table := newAffinityTable(10, time.Minute)
+	table.put("1", a)
+	table.setFallback("1", a)
+	if table.getFallback("1") != a {
+		t.Error("fallback not stored")
+	}
+
+	table.entries["1"].Value.(*affinityEntry).expiry = time.Now().Add(-time.Second)
+	if _, err := table.get("1"); err == nil {
+		t.Error("expired entry returned")
+	}
+	if table.getFallback("1") != nil {
+		t.Error("fallback of an expired entry returned")
+	}
+}
+
+func TestStickinessTableSize(t *testing.T) {
+	for _, size := range []int{-1, -100} {
+		group := &Group{Stickiness: &Stickiness{Mode: STICKY_SOURCE_IP, TableSize: size}}
+		if err := group.initAffinity(); err == nil {
+			t.Errorf("tableSize %d accepted", size)
+		}
+	}
+
+	group := &Group{Stickiness: &Stickiness{Mode: STICKY_SOURCE_IP}}
+	if err := group.initAffinity(); err != nil {
+		t.Fatal(err)
+	}
+	if size := group.affinity.(*sourceIPAffinity).table.size; size != DefaultStickyTableSize {
+		t.Errorf("default table size = %d, want %d", size, DefaultStickyTableSize)
+	}
+}
+
+func TestLearnAffinity(t *testing.T) {
+	a := &Endpoint{Address: "a"}
+	learn := &learnAffinity{cookieName: "JSESSIONID", table: newAffinityTable(10, time.Minute)}
+
+	request := func(value string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if value != "" {
+			r.AddCookie(&http.Cookie{Name: "JSESSIONID", Value: value})
+		}
+		return r
+	}
+
+	resp := &http.Response{Header: http.Header{}, Request: request("")}
+	resp.Header.Add("Set-Cookie", "JSESSIONID=abc; Path=/")
+	learn.learn(resp, a)
+
+	if got, err := learn.get(request("abc"), nil); err != nil || got != a {
+		t.Errorf("learned session not found: %v, %v", got, err)
+	}
+	if _, err := learn.get(request(""), nil); err == nil {
+		t.Error("request without the application cookie matched")
+	}
+
+	logout := &http.Response{Header: http.Header{}, Request: request("abc")}
+	logout.Header.Add("Set-Cookie", "JSESSIONID=; Max-Age=0")
+	learn.learn(logout, a)
+	if _, err := learn.get(request("abc"), nil); err == nil {
+		t.Error("session deleted by the endpoint still pinned")
+	}
+}
+
+func stickyGroup(t *testing.T, policy string, endpoints ...*Endpoint) *Group {
+	t.Helper()
+	group := &Group{
+		Endpoints:  endpoints,
+		Stickiness: &Stickiness{Mode: STICKY_SOURCE_IP, FailoverPolicy: policy},
+	}
+	if err := group.initBalancing(); err != nil {
+		t.Fatal(err)
+	}
+	if err := group.initAffinity(); err != nil {
+		t.Fatal(err)
+	}
+	return group
+}
+
+func TestStrictFailover(t *testing.T) {
+	from, to := aliveEndpoint("http://a"), aliveEndpoint("http://b")
+	group := stickyGroup(t, FAILOVER_STRICT, from, to)
+
+	from.Alive.Store(false)
+	w := httptest.NewRecorder()
+	if _, err := group.migrateSession(w, httptest.NewRequest(http.MethodGet, "/", nil), from); err == nil {
+		t.Error("strict policy moved the session of a down endpoint")
+	}
+
+	//a drained endpoint is not coming back, its sessions are rebalanced
+	from.Alive.Store(true)
+	from.draining.Store(true)
+	from.drained.Store(true)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	got, err := group.migrateSession(w, r, from)
+	if err != nil || got != to {
+		t.Fatalf("session of a drained endpoint not rebalanced: %v, %v", got, err)
+	}
+	if pinned, _ := group.affinity.get(r, group.Endpoints); pinned != to {
+		t.Error("the session was not pinned to the new endpoint")
+	}
+	if r.Header.Get(DefaultMigrationHeader) != "true" {
+		t.Error("migration header not set")
+	}
+
+	group.affinity.(*sourceIPAffinity).table.put("10.0.0.1", from)
+	raw, err := group.pickRawEndpoint(&testAddr{"10.0.0.1:1234"})
+	if err != nil || raw != to {
+		t.Errorf("raw connection of a drained session not rebalanced: %v, %v", raw, err)
+	}
+}
+
+func TestReturnWhenHealthyFailover(t *testing.T) {
+	home, other := aliveEndpoint("http://a"), aliveEndpoint("http://b")
+	group := stickyGroup(t, FAILOVER_RETURN_WHEN_HEALTHY, home, other)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	group.affinity.set(nil, r, home)
+
+	home.Alive.Store(false)
+	got, err := group.migrateSession(httptest.NewRecorder(), r, home)
+	if err != nil || got != other {
+		t.Fatalf("migrateSession = %v, %v", got, err)
+	}
+	if pinned, _ := group.affinity.get(r, group.Endpoints); pinned != home {
+		t.Error("return-when-healthy must keep the original endpoint pinned")
+	}
+	if group.affinity.getFallback(r, group.Endpoints) != other {
+		t.Error("temporary endpoint not stored")
+	}
+}
+
+type testAddr struct {
+	address string
+}
+
+func (a *testAddr) Network() string { return "tcp" }
+func (a *testAddr) String() string  { return a.address }
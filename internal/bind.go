@@ -4,13 +4,13 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"path"
 	"strings"
 	"time"
 
-	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 )
 
@@ -23,7 +23,10 @@ const (
 )
 
 type Bind struct {
-	Protocol          string        `json:"protocol,omitempty"`
+	//legacy, see protocols
+	Protocol string `json:"protocol,omitempty"`
+	//any of h1, h2, h2c, h3, or tcp or udp alone for raw traffic
+	Protocols         []string      `json:"protocols,omitempty"`
 	RedirectToHttps   bool          `json:"redirectToHttps,omitempty"`
 	Address           string        `json:"address"`
 	VirtualHost       bool          `json:"virtualHost"`
@@ -34,8 +37,18 @@ type Bind struct {
 	WriteTimeout      string        `json:"writeTimout,omitempty"`
 	IdleTimeout       string        `json:"idleTimout,omitempty"`
 	MaxHeaderBytes    int           `json:"maxHeaderBytes,omitempty"`
+	ErrorPages        *ErrorPages   `json:"errorPages,omitempty"`
+	ClientAuth        *ClientAuth   `json:"clientAuth,omitempty"`
+	TLS               *TLSPolicy    `json:"tls,omitempty"`
+	OCSP              *OCSPStapling `json:"ocsp,omitempty"`
 	Http12Server      *http.Server  `json:"-"`
 	Http3Server       *http3.Server `json:"-"`
+	conf              *Conf         `json:"-"`
+	ticketKeys        *ticketKeys   `json:"-"`
+	stapler           *ocspStapler  `json:"-"`
+	servers           *supervisor   `json:"-"`
+	raw               *rawServer    `json:"-"`
+	udp               *udpServer    `json:"-"`
 }
 
 type SSL struct {
@@ -51,7 +64,7 @@ func grabGroup(g []*Group, r *http.Request) (*Group, error) {
 	for i := 0; i < groupLen; i++ {
 		currentGroup := g[i]
 
-		if currentGroup.Address == hostname && currentGroup.isPathCompliant(r) {
+		if currentGroup.raw == "" && currentGroup.Address == hostname && currentGroup.isPathCompliant(r) {
 			group = currentGroup
 		}
 	}
@@ -63,22 +76,38 @@ func grabGroup(g []*Group, r *http.Request) (*Group, error) {
 	return nil, errors.New("group not found")
 }
 
+// first group not routed by SNI, nil when every group is tlsPassthrough
+func (bind *Bind) firstGroup() *Group {
+	for _, group := range bind.Groups {
+		if !group.TLSPassthrough {
+			return group
+		}
+	}
+	return nil
+}
+
 func (bind *Bind) reverseproxyHandler(w http.ResponseWriter, r *http.Request) {
+	stripH2CUpgrade(r)
+
+	if bind.ClientAuth != nil {
+		bind.ClientAuth.forwardClientCert(r)
+	}
+
 	panicked := catchUnwind(func() {
 		if bind.VirtualHost {
 			group, e := grabGroup(bind.Groups, r)
 			if e == nil {
 				group.handleRequest(w, r)
 			} else {
-				http.Error(w, "Service not available", http.StatusServiceUnavailable)
+				bind.ErrorPages.writeError(w, r, http.StatusServiceUnavailable, defaultErrorMessage)
 			}
 		} else {
 			//pick only the first one, with domain resolution to false every listener is
 			//directly connected to endopints without hostname distinction
-			firstGroup := bind.Groups[0]
-			if !firstGroup.isPathCompliant(r) {
+			firstGroup := bind.firstGroup()
+			if firstGroup == nil || !firstGroup.isPathCompliant(r) {
 				slog.Debug("path not compliant with the only group running")
-				http.Error(w, "Service not available", http.StatusServiceUnavailable)
+				bind.ErrorPages.writeError(w, r, http.StatusServiceUnavailable, defaultErrorMessage)
 			} else {
 				firstGroup.handleRequest(w, r)
 			}
@@ -86,7 +115,7 @@ func (bind *Bind) reverseproxyHandler(w http.ResponseWriter, r *http.Request) {
 	})
 
 	if panicked {
-		http.Error(w, "Service not available", http.StatusInternalServerError)
+		bind.ErrorPages.writeError(w, r, http.StatusInternalServerError, defaultErrorMessage)
 	}
 }
 
@@ -127,148 +156,95 @@ func (bind *Bind) generateServerTLS() []tls.Certificate {
 	return certs
 }
 
-func (bind *Bind) Start() error {
+func (bind *Bind) Start(conf *Conf) error {
+	bind.conf = conf
+
+	if err := bind.ErrorPages.Start(conf.BasePath); err != nil {
+		return err
+	}
+
+	protocols, err := bind.protocolSet()
+	if err != nil {
+		return err
+	}
+	if err := bind.checkClientAuth(); err != nil {
+		return err
+	}
+
+	raw := ""
+	for _, network := range []string{PROTO_TCP, PROTO_UDP} {
+		if protocols[network] {
+			raw = network
+		}
+	}
 
 	for _, group := range bind.Groups {
-		if err := group.Start(); err != nil {
-			slog.Error("error initializing group", "error", err)
+		group.raw = raw
+		if group.TLSPassthrough {
+			if raw == PROTO_UDP {
+				return fmt.Errorf("tlsPassthrough groups cannot be served by udp bind %s", bind.Address)
+			}
+			group.raw = PROTO_TCP
+		}
+		if err := bind.checkGroupClientCert(group); err != nil {
+			return err
 		}
+		if err := group.Start(conf); err != nil {
+			return fmt.Errorf("error initializing group of bind %s: %w", bind.Address, err)
+		}
+		group.ErrorPages = group.ErrorPages.inherit(bind.ErrorPages)
 	}
 
 	for i := range bind.SSL {
-		basePath := runningConf.BasePath
+		basePath := conf.BasePath
 		bind.SSL[i].KeyFilePath = path.Join(basePath, bind.SSL[i].KeyFilePath)
 		bind.SSL[i].CertFilePath = path.Join(basePath, bind.SSL[i].CertFilePath)
 	}
 
-	bind.Protocol = strings.ToUpper(bind.Protocol)
-	switch bind.Protocol {
-	case "HTTP/2":
-		{
-			if bind.SSL == nil {
-				return errors.New("cannot start HTTP/2 without SSL certificate")
-			}
-
-			bind.Http12Server =
-				&http.Server{
-					Addr:              bind.Address,
-					TLSConfig:         &tls.Config{Certificates: bind.generateServerTLS()},
-					ReadTimeout:       getWithDefaultDuration(bind.ReadTimeout, DefaultReadTimeout),
-					ReadHeaderTimeout: getWithDefaultDuration(bind.ReadHeaderTimeout, DefaultReadHeaderTimeout),
-					WriteTimeout:      getWithDefaultDuration(bind.WriteTimeout, DefaultWriteTimeout),
-					IdleTimeout:       getWithDefaultDuration(bind.IdleTimeout, DefaultIdleTimeout),
-					MaxHeaderBytes:    getWithDefaultInt(bind.MaxHeaderBytes, DefaultMaxHeaderBytes),
-					Handler:           http.HandlerFunc(bind.reverseproxyHandler),
-				}
-
-			go func() {
-				err := bind.Http12Server.ListenAndServeTLS("", "")
-				if err != nil {
-					slog.Error("Unable to start binding", "error", err)
-				}
-			}()
-			break
-		}
-	case "HTTP/3":
-		{
-			if bind.SSL == nil {
-				return errors.New("cannot start HTTP/3 without SSL certificate")
-			}
-
-			bind.Http12Server =
-				&http.Server{
-					Addr:              bind.Address,
-					TLSConfig:         &tls.Config{Certificates: bind.generateServerTLS()},
-					ReadTimeout:       getWithDefaultDuration(bind.ReadTimeout, DefaultReadTimeout),
-					ReadHeaderTimeout: getWithDefaultDuration(bind.ReadHeaderTimeout, DefaultReadHeaderTimeout),
-					WriteTimeout:      getWithDefaultDuration(bind.WriteTimeout, DefaultWriteTimeout),
-					IdleTimeout:       getWithDefaultDuration(bind.IdleTimeout, DefaultIdleTimeout),
-					MaxHeaderBytes:    getWithDefaultInt(bind.MaxHeaderBytes, DefaultMaxHeaderBytes),
-					Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-						bind.Http3Server.SetQUICHeaders(w.Header())
-						bind.reverseproxyHandler(w, r)
-					}),
-				}
-
-			bind.Http3Server = &http3.Server{
-				Addr:           bind.Address,
-				TLSConfig:      &tls.Config{Certificates: bind.generateServerTLS()},
-				IdleTimeout:    getWithDefaultDuration(bind.IdleTimeout, DefaultIdleTimeout),
-				MaxHeaderBytes: getWithDefaultInt(bind.MaxHeaderBytes, DefaultMaxHeaderBytes),
-				QUICConfig:     &quic.Config{Allow0RTT: true},
-				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					bind.Http3Server.SetQUICHeaders(w.Header())
-					bind.reverseproxyHandler(w, r)
-				}),
-			}
+	if raw != "" && len(bind.Groups) == 0 {
+		return fmt.Errorf("%s bind %s has no group", raw, bind.Address)
+	}
+	switch raw {
+	case PROTO_TCP:
+		return bind.startRawServer()
+	case PROTO_UDP:
+		return bind.startUDPServer()
+	}
 
-			httpErr := make(chan error, 1)
-			quicErr := make(chan error, 1)
-			go func() {
-				quicErr <- bind.Http3Server.ListenAndServe()
-			}()
-			go func() {
-				httpErr <- bind.Http12Server.ListenAndServeTLS("", "")
-			}()
-
-			go func() {
-				select {
-				case err := <-httpErr:
-					bind.Http3Server.Close()
-					slog.Error("", "error", err)
-				case err := <-quicErr:
-					// Cannot close the HTTP server or wait for requests to complete properly
-					slog.Error("", "error", err)
-				}
-			}()
-		}
-	default:
-		{
-			bind.Http12Server =
-				&http.Server{
-					Addr:              bind.Address,
-					TLSNextProto:      nil,
-					TLSConfig:         &tls.Config{Certificates: bind.generateServerTLS()},
-					ReadTimeout:       getWithDefaultDuration(bind.ReadTimeout, DefaultReadTimeout),
-					ReadHeaderTimeout: getWithDefaultDuration(bind.ReadHeaderTimeout, DefaultReadHeaderTimeout),
-					WriteTimeout:      getWithDefaultDuration(bind.WriteTimeout, DefaultWriteTimeout),
-					IdleTimeout:       getWithDefaultDuration(bind.IdleTimeout, DefaultIdleTimeout),
-					MaxHeaderBytes:    getWithDefaultInt(bind.MaxHeaderBytes, DefaultMaxHeaderBytes),
-					Handler:           http.HandlerFunc(bind.reverseproxyHandler),
-				}
-
-			go func() {
-				var err error
-				if bind.Http12Server.TLSConfig == nil || len(bind.Http12Server.TLSConfig.Certificates) == 0 {
-					err = bind.Http12Server.ListenAndServe()
-				} else {
-					err = bind.Http12Server.ListenAndServeTLS("", "")
-				}
-				if err != nil {
-					slog.Error("Unable to start binding", "error", err)
-				}
-			}()
-		}
+	tlsConfig, err := bind.serverTLSConfig()
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return bind.startServers(tlsConfig, protocols)
 }
 
-func (bind *Bind) Stop() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+func (bind *Bind) Stop(ctx context.Context) error {
+	for _, group := range bind.Groups {
+		group.Stop()
+	}
 
-	if bind.Http12Server != nil {
-		if err := bind.Http12Server.Shutdown(ctx); err != nil {
-			return err
-		}
+	if bind.ticketKeys != nil {
+		bind.ticketKeys.Stop()
+		bind.ticketKeys = nil
 	}
 
-	if bind.Http3Server != nil {
-		if err := bind.Http3Server.CloseGracefully(5 * time.Second); err != nil {
-			return err
-		}
+	if bind.stapler != nil {
+		bind.stapler.Stop()
+		bind.stapler = nil
 	}
 
-	return nil
+	//HTTP servers first, their listener feeds the passthrough connections
+	errs := []error{bind.stopServers(ctx)}
+
+	if bind.raw != nil {
+		errs = append(errs, bind.raw.Stop(ctx))
+		bind.raw = nil
+	}
+	if bind.udp != nil {
+		errs = append(errs, bind.udp.Stop(ctx))
+		bind.udp = nil
+	}
+
+	return errors.Join(errs...)
 }
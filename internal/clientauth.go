@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+const (
+	CLIENT_AUTH_NONE    = "none"
+	CLIENT_AUTH_REQUEST = "request"
+	CLIENT_AUTH_REQUIRE = "require"
+)
+
+// client certificate verification of a bind (mutual TLS)
+type ClientAuth struct {
+	//none (default), request (verified when given) or require (require and verify)
+	Mode string `json:"mode"`
+	//PEM bundle of the CAs allowed to sign client certificates, relative to basePath
+	CAFileName string `json:"caFileName,omitempty"`
+	//headers used to forward the verified certificate to endpoints, defaults when omitted
+	Headers *ClientCertHeaders `json:"headers,omitempty"`
+}
+
+// empty names are not forwarded, incoming headers with these names are always removed
+type ClientCertHeaders struct {
+	Subject     string `json:"subject,omitempty"`
+	Issuer      string `json:"issuer,omitempty"`
+	SANs        string `json:"sans,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	//url escaped PEM of the leaf certificate
+	Cert string `json:"cert,omitempty"`
+}
+
+var defaultClientCertHeaders = ClientCertHeaders{
+	Subject:     "X-Client-Cert-Subject",
+	Issuer:      "X-Client-Cert-Issuer",
+	SANs:        "X-Client-Cert-Sans",
+	Fingerprint: "X-Client-Cert-Fingerprint",
+}
+
+// per group requirement, only certificates verified by the bind are considered
+type GroupClientCert struct {
+	Required bool `json:"required"`
+	//matched against the subject common name or the whole subject, e.g. "CN=api,O=acme"
+	AllowedSubjects []string `json:"allowedSubjects,omitempty"`
+	//matched against DNS names, emails, URIs and IP addresses
+	AllowedSANs []string `json:"allowedSans,omitempty"`
+}
+
+func (ca *ClientAuth) apply(config *tls.Config, basePath string) error {
+	if ca.CAFileName != "" {
+		read, err := os.ReadFile(path.Join(basePath, ca.CAFileName))
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(read) {
+			return fmt.Errorf("no certificate found in client CA file %s", ca.CAFileName)
+		}
+		config.ClientCAs = pool
+	}
+
+	switch strings.ToLower(ca.Mode) {
+	case "", CLIENT_AUTH_NONE:
+		config.ClientAuth = tls.NoClientCert
+	case CLIENT_AUTH_REQUEST:
+		if config.ClientCAs == nil {
+			return errors.New("client auth request mode requires caFileName")
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case CLIENT_AUTH_REQUIRE:
+		if config.ClientCAs == nil {
+			return errors.New("client auth require mode requires caFileName")
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return fmt.Errorf("unknown client auth mode %q", ca.Mode)
+	}
+	return nil
+}
+
+// headers are needed by every request of the bind, even when the handshake is not configured
+func (ca *ClientAuth) defaultHeaders() {
+	if ca.Headers == nil {
+		headers := defaultClientCertHeaders
+		ca.Headers = &headers
+	}
+}
+
+// client certificates only exist on TLS connections
+func (bind *Bind) checkClientAuth() error {
+	if bind.ClientAuth != nil && len(bind.SSL) == 0 {
+		return fmt.Errorf("clientAuth of bind %s requires SSL certificates", bind.Address)
+	}
+	return nil
+}
+
+// false when the bind never asks clients for a certificate
+func (bind *Bind) requestsClientCert() bool {
+	if len(bind.SSL) == 0 || bind.ClientAuth == nil {
+		return false
+	}
+	mode := strings.ToLower(bind.ClientAuth.Mode)
+	return mode == CLIENT_AUTH_REQUEST || mode == CLIENT_AUTH_REQUIRE
+}
+
+// a group requiring certificates the bind never requests would refuse every request
+func (bind *Bind) checkGroupClientCert(group *Group) error {
+	if group.ClientCert == nil || !group.ClientCert.Required || bind.requestsClientCert() {
+		return nil
+	}
+	return fmt.Errorf("group %s%s requires client certificates but bind %s does not request them, set clientAuth mode to request or require",
+		group.Address, group.Path, bind.Address)
+}
+
+func verifiedClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+func certSANs(cert *x509.Certificate) []string {
+	sans := slices.Clone(cert.DNSNames)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return sans
+}
+
+// replaces any client supplied value with the details of the verified certificate
+func (ca *ClientAuth) forwardClientCert(r *http.Request) {
+	h := ca.Headers
+	for _, name := range []string{h.Subject, h.Issuer, h.SANs, h.Fingerprint, h.Cert} {
+		if name != "" {
+			r.Header.Del(name)
+		}
+	}
+
+	cert := verifiedClientCert(r)
+	if cert == nil {
+		return
+	}
+
+	if h.Subject != "" {
+		r.Header.Set(h.Subject, cert.Subject.String())
+	}
+	if h.Issuer != "" {
+		r.Header.Set(h.Issuer, cert.Issuer.String())
+	}
+	if h.SANs != "" {
+		r.Header.Set(h.SANs, strings.Join(certSANs(cert), ","))
+	}
+	if h.Fingerprint != "" {
+		sum := sha256.Sum256(cert.Raw)
+		r.Header.Set(h.Fingerprint, hex.EncodeToString(sum[:]))
+	}
+	if h.Cert != "" {
+		r.Header.Set(h.Cert, url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))))
+	}
+}
+
+func (gc *GroupClientCert) allowed(r *http.Request) bool {
+	cert := verifiedClientCert(r)
+	if cert == nil {
+		return !gc.Required
+	}
+
+	if len(gc.AllowedSubjects) == 0 && len(gc.AllowedSANs) == 0 {
+		return true
+	}
+
+	for _, subject := range gc.AllowedSubjects {
+		if subject == cert.Subject.CommonName || subject == cert.Subject.String() {
+			return true
+		}
+	}
+
+	for _, san := range certSANs(cert) {
+		if slices.Contains(gc.AllowedSANs, san) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,248 @@
+package internal
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// certificate signed by parent, self signed when parent is nil
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func newTestCA(t *testing.T) *testCert {
+	return newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}, nil)
+}
+
+func (c *testCert) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+func (c *testCert) tlsCertificate(chain ...*testCert) tls.Certificate {
+	certificate := tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+	for _, issuer := range chain {
+		certificate.Certificate = append(certificate.Certificate, issuer.cert.Raw)
+	}
+	return certificate
+}
+
+func requestWithClientCert(cert *testCert) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.TLS = &tls.ConnectionState{}
+	if cert != nil {
+		r.TLS.VerifiedChains = [][]*x509.Certificate{{cert.cert}}
+	}
+	return r
+}
+
+func TestClientAuthApply(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	if err := os.WriteFile(filepath.Join(dir, "ca.pem"), ca.pem(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "empty.pem"), []byte("no certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		mode   string
+		caFile string
+		want   tls.ClientAuthType
+		fails  bool
+	}{
+		{"", "", tls.NoClientCert, false},
+		{"request", "ca.pem", tls.VerifyClientCertIfGiven, false},
+		{"REQUIRE", "ca.pem", tls.RequireAndVerifyClientCert, false},
+		{"require", "", 0, true},
+		{"require", "empty.pem", 0, true},
+		{"optional", "ca.pem", 0, true},
+	}
+
+	for _, test := range tests {
+		config := &tls.Config{}
+		ca := &ClientAuth{Mode: test.mode, CAFileName: test.caFile}
+		err := ca.apply(config, dir)
+		if test.fails {
+			if err == nil {
+				t.Errorf("mode %q with %q accepted", test.mode, test.caFile)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("mode %q: %v", test.mode, err)
+			continue
+		}
+		if config.ClientAuth != test.want {
+			t.Errorf("mode %q: client auth %v", test.mode, config.ClientAuth)
+		}
+	}
+}
+
+func TestForwardClientCert(t *testing.T) {
+	ca := newTestCA(t)
+	client := newTestCert(t, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "api", Organization: []string{"acme"}},
+		DNSNames: []string{"api.acme.org"},
+	}, ca)
+
+	headers := defaultClientCertHeaders
+	headers.Cert = "X-Client-Cert"
+	auth := &ClientAuth{Headers: &headers}
+
+	r := requestWithClientCert(client)
+	r.Header.Set("X-Client-Cert-Subject", "CN=spoofed")
+	auth.forwardClientCert(r)
+
+	if got := r.Header.Get("X-Client-Cert-Subject"); got != "CN=api,O=acme" {
+		t.Errorf("subject = %q", got)
+	}
+	if got := r.Header.Get("X-Client-Cert-Issuer"); got != "CN=test ca" {
+		t.Errorf("issuer = %q", got)
+	}
+	if got := r.Header.Get("X-Client-Cert-Sans"); got != "api.acme.org" {
+		t.Errorf("sans = %q", got)
+	}
+	if got := r.Header.Get("X-Client-Cert-Fingerprint"); len(got) != 64 {
+		t.Errorf("fingerprint = %q", got)
+	}
+	if got := r.Header.Get("X-Client-Cert"); !strings.Contains(got, "BEGIN+CERTIFICATE") {
+		t.Errorf("cert = %q", got)
+	}
+
+	anonymous := requestWithClientCert(nil)
+	anonymous.Header.Set("X-Client-Cert-Subject", "CN=spoofed")
+	auth.forwardClientCert(anonymous)
+	if got := anonymous.Header.Get("X-Client-Cert-Subject"); got != "" {
+		t.Errorf("client supplied header forwarded without a certificate: %q", got)
+	}
+}
+
+func TestGroupClientCertAllowed(t *testing.T) {
+	ca := newTestCA(t)
+	api := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "api"}, DNSNames: []string{"api.acme.org"}}, ca)
+	web := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "web"}, EmailAddresses: []string{"web@acme.org"}}, ca)
+
+	tests := []struct {
+		name  string
+		gc    *GroupClientCert
+		cert  *testCert
+		allow bool
+	}{
+		{"optional without cert", &GroupClientCert{}, nil, true},
+		{"required without cert", &GroupClientCert{Required: true}, nil, false},
+		{"required with cert", &GroupClientCert{Required: true}, api, true},
+		{"subject allowed", &GroupClientCert{AllowedSubjects: []string{"api"}}, api, true},
+		{"subject not allowed", &GroupClientCert{AllowedSubjects: []string{"api"}}, web, false},
+		{"san allowed", &GroupClientCert{AllowedSANs: []string{"web@acme.org"}}, web, true},
+		{"san not allowed", &GroupClientCert{AllowedSANs: []string{"web@acme.org"}}, api, false},
+	}
+
+	for _, test := range tests {
+		if got := test.gc.allowed(requestWithClientCert(test.cert)); got != test.allow {
+			t.Errorf("%s: allowed = %v, want %v", test.name, got, test.allow)
+		}
+	}
+}
+
+func TestGroupClientCertNeedsBindClientAuth(t *testing.T) {
+	required := &Group{Path: "/", ClientCert: &GroupClientCert{Required: true}}
+	ssl := []*SSL{{CertFilePath: "server.crt", KeyFilePath: "server.key"}}
+
+	tests := []struct {
+		name  string
+		bind  *Bind
+		fails bool
+	}{
+		{"no client auth", &Bind{SSL: ssl}, true},
+		{"mode none", &Bind{SSL: ssl, ClientAuth: &ClientAuth{Mode: "none"}}, true},
+		{"no tls", &Bind{ClientAuth: &ClientAuth{Mode: "require"}}, true},
+		{"request", &Bind{SSL: ssl, ClientAuth: &ClientAuth{Mode: "request"}}, false},
+		{"require", &Bind{SSL: ssl, ClientAuth: &ClientAuth{Mode: "Require"}}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.bind.checkGroupClientCert(required); (err != nil) != test.fails {
+			t.Errorf("%s: error %v, want failure %v", test.name, err, test.fails)
+		}
+	}
+
+	optional := &Group{ClientCert: &GroupClientCert{AllowedSubjects: []string{"api"}}}
+	if err := (&Bind{}).checkGroupClientCert(optional); err != nil {
+		t.Errorf("optional client certificate rejected: %v", err)
+	}
+}
+
+func TestPlaintextBindClientAuth(t *testing.T) {
+	for _, mode := range []string{"none", "request", "require"} {
+		config := testBindConf(fmt.Sprintf(`"clientAuth": {"mode": %q},`, mode), "", "http://127.0.0.1:1")
+		conf, err := ParseConf([]byte(config), t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conf.Start(); err == nil {
+			conf.Stop(context.Background())
+			t.Errorf("mode %s accepted on a plaintext bind", mode)
+		}
+	}
+
+	//headers are set even without TLS, requests never dereference a nil configuration
+	bind := &Bind{ClientAuth: &ClientAuth{Mode: "none"}}
+	if _, err := bind.serverTLSConfig(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(defaultClientCertHeaders.Subject, "CN=forged")
+	bind.ClientAuth.forwardClientCert(r)
+	if r.Header.Get(defaultClientCertHeaders.Subject) != "" {
+		t.Error("client supplied certificate header forwarded")
+	}
+}
@@ -1,59 +1,103 @@
 package internal
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"log/slog"
 	"os"
 	"os/signal"
 	"path"
-	"sync"
+	"syscall"
+	"time"
 )
 
 const CONF_FILE_NAME string = "conf.json"
 
-var runningConf *Conf
+// time given to listeners to complete in flight requests on interrupt
+const shutdownTimeout time.Duration = 5 * time.Second
 
 type Global struct {
 	Logger *Logger `json:"logger"`
+	//Prometheus metrics endpoint, disabled when not set
+	Metrics *Metrics `json:"metrics,omitempty"`
 }
 
 func (global *Global) Stop() {
-	global.Logger.Stop()
+	if global.Metrics != nil {
+		if err := global.Metrics.Stop(); err != nil {
+			slog.Error("error stopping metrics server", "error", err)
+		}
+	}
+	if global.Logger != nil {
+		global.Logger.Stop()
+	}
 }
 
-func (global *Global) Start() error {
-	return global.Logger.Start()
+func (global *Global) Start(metrics *balancerMetrics) error {
+	if global.Logger != nil {
+		if err := global.Logger.Start(); err != nil {
+			return err
+		}
+	}
+	if global.Metrics != nil {
+		return global.Metrics.Start(metrics.registry)
+	}
+	return nil
 }
 
+// Conf holds the whole state of a balancer instance, metrics included, nothing is
+// shared between instances apart from the process wide logger configured by Global
 type Conf struct {
-	Settings        *LoadBalancerSettings `json:"settings"`
-	Global          *Global               `json:"global"`
-	BasePath        string                `json:"basePath"`
-	interruptSignal chan os.Signal        `json:"-"`
-	Wg              *sync.WaitGroup       `json:"-"`
+	Settings *LoadBalancerSettings `json:"settings"`
+	Global   *Global               `json:"global"`
+	BasePath string                `json:"basePath"`
+	path     string                `json:"-"`
+	metrics  *balancerMetrics      `json:"-"`
 }
 
-// Initializing Conf. Reading conf file (default is ./conf.json)
-// but can be overriden by passing `--conf confpath`
-func FromFile() error {
-
-	confPath := flag.String("conf", CONF_FILE_NAME, "configuration file path")
-	flag.Parse()
-
-	read, err := os.ReadFile(*confPath)
+// Reading and parsing a configuration file, BasePath defaults to the file directory
+func LoadConf(confPath string) (*Conf, error) {
+	read, err := os.ReadFile(confPath)
 	//if file not found
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	pathDir := path.Dir(*confPath)
-	conf := &Conf{BasePath: pathDir}
+	conf, err := ParseConf(read, path.Dir(confPath))
+	if err != nil {
+		return nil, err
+	}
+	conf.path = confPath
+	return conf, nil
+}
 
-	err = json.Unmarshal(read, conf)
+func ParseConf(read []byte, basePath string) (*Conf, error) {
+	conf := &Conf{BasePath: basePath}
 
-	if err != nil {
+	if err := json.Unmarshal(read, conf); err != nil {
 		slog.Error("error during file unmarshal", "error", err)
+		return nil, err
+	}
+
+	if conf.Settings == nil {
+		return nil, errors.New("missing settings in configuration")
+	}
+
+	return conf, nil
+}
+
+// Initializing Conf. Reading conf file (default is ./conf.json)
+// but can be overriden by passing `--conf confpath`.
+// Blocks until an interrupt signal is received, SIGHUP reloads the configuration.
+func FromFile() error {
+
+	confPath := flag.String("conf", CONF_FILE_NAME, "configuration file path")
+	flag.Parse()
+
+	conf, err := LoadConf(*confPath)
+	if err != nil {
 		return err
 	}
 
@@ -64,19 +108,38 @@ func FromFile() error {
 		return err
 	}
 
-	conf.Wg = &sync.WaitGroup{}
-	conf.Wg.Add(1)
-	conf.Wg.Wait()
-
-	return nil
+	osInterrupt := make(chan os.Signal, 1)
+	signal.Notify(osInterrupt, os.Interrupt)
+	defer signal.Stop(osInterrupt)
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	for {
+		select {
+		case <-reload:
+			if err := conf.reload(); err != nil {
+				slog.Error("error reloading configuration", "error", err)
+			}
+		case <-osInterrupt:
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			return conf.Stop(ctx)
+		}
+	}
 }
 
 func (conf *Conf) Start() error {
-	runningConf = conf
+	if conf.metrics == nil {
+		conf.metrics = newBalancerMetrics()
+	}
 
-	e := conf.Global.Start()
-	if e != nil {
-		return e
+	if conf.Global != nil {
+		e := conf.Global.Start(conf.metrics)
+		if e != nil {
+			return e
+		}
 	}
 
 	// e = conf.Api.Start()
@@ -84,33 +147,39 @@ func (conf *Conf) Start() error {
 	// 	return e
 	// }
 
-	conf.startInterruptSignalReceiver()
-	e = conf.Settings.Start()
-
-	if e != nil {
-		return e
-	}
-	return nil
+	return conf.Settings.Start(conf)
 }
 
-func (conf *Conf) Stop() {
-	close(conf.interruptSignal)
+func (conf *Conf) Stop(ctx context.Context) error {
 	// conf.Api.Stop()
-	conf.Settings.Stop()
-	conf.Global.Stop()
+	err := conf.Settings.Stop(ctx)
+	if conf.Global != nil {
+		conf.Global.Stop()
+	}
+	return err
 }
 
-func (conf *Conf) startInterruptSignalReceiver() {
-	osInterrupt := make(chan os.Signal, 1)
-	conf.interruptSignal = osInterrupt
-	signal.Notify(osInterrupt, os.Interrupt)
-	go func() {
-		signal := <-osInterrupt
-		if signal != nil {
-			// conf.Api.Stop()
-			conf.Settings.Stop()
-			conf.Global.Stop()
-			conf.Wg.Done()
-		}
-	}()
+// the configuration file is read again and the endpoints draining state is applied,
+// every other change requires a restart
+func (conf *Conf) reload() error {
+	if conf.path == "" {
+		return errors.New("configuration was not loaded from a file")
+	}
+
+	read, err := os.ReadFile(conf.path)
+	if err != nil {
+		return err
+	}
+
+	reloaded := &Conf{}
+	if err = json.Unmarshal(read, reloaded); err != nil {
+		return err
+	}
+
+	if reloaded.Settings != nil {
+		conf.Settings.applyDrainState(reloaded.Settings)
+	}
+
+	slog.Info("configuration reloaded", "path", conf.path)
+	return nil
 }
@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"log/slog"
+	"time"
+)
+
+const (
+	DefaultDrainTimeout time.Duration = 5 * time.Minute
+	drainPollInterval   time.Duration = 500 * time.Millisecond
+	//a request balanced just before the drain, or a sticky session request, can start
+	//right after ActiveConnections was read as zero
+	drainIdleGrace time.Duration = 2 * drainPollInterval
+)
+
+// A draining endpoint receives no new requests and no new sticky sessions,
+// existing sticky sessions are served until ActiveConnections stays at zero for
+// drainIdleGrace or the drain timeout expires, after that the endpoint is drained.
+// The draining and drained flags are written only under drainMu, so a concurrent
+// Undrain cannot be overwritten by the watcher of a previous Drain.
+func (endpoint *Endpoint) Drain() {
+	endpoint.drainMu.Lock()
+	defer endpoint.drainMu.Unlock()
+
+	if endpoint.draining.Load() {
+		return
+	}
+	endpoint.draining.Store(true)
+	endpoint.drained.Store(false)
+
+	stop := make(chan struct{})
+	endpoint.drainStop = stop
+
+	timeout := getWithDefaultDuration(endpoint.DrainTimeout, DefaultDrainTimeout)
+	slog.Info("endpoint draining", "endpoint", endpoint.Address, "timeout", timeout)
+
+	go endpoint.watchDrain(timeout, stop)
+}
+
+func (endpoint *Endpoint) watchDrain(timeout time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+	//consecutive polls reading zero, the first one can be right after the last request
+	idlePolls := 0
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-deadline:
+			if endpoint.completeDrain(stop) {
+				slog.Info("endpoint drain completed", "endpoint", endpoint.Address, "timedOut", true,
+					"activeConnections", endpoint.ActiveConnections.Load())
+			}
+			return
+		case <-ticker.C:
+			if endpoint.ActiveConnections.Load() != 0 {
+				idlePolls = 0
+				continue
+			}
+			idlePolls++
+			if time.Duration(idlePolls-1)*drainPollInterval < drainIdleGrace {
+				continue
+			}
+			if endpoint.completeDrain(stop) {
+				slog.Info("endpoint drain completed", "endpoint", endpoint.Address, "timedOut", false)
+			}
+			return
+		}
+	}
+}
+
+// marks the endpoint drained unless stop was closed by Undrain in the meantime
+func (endpoint *Endpoint) completeDrain(stop chan struct{}) bool {
+	endpoint.drainMu.Lock()
+	defer endpoint.drainMu.Unlock()
+
+	if endpoint.drainStop != stop {
+		return false
+	}
+	endpoint.drained.Store(true)
+	return true
+}
+
+// puts back the endpoint in rotation
+func (endpoint *Endpoint) Undrain() {
+	endpoint.drainMu.Lock()
+	defer endpoint.drainMu.Unlock()
+
+	if !endpoint.draining.Load() {
+		return
+	}
+	endpoint.draining.Store(false)
+
+	if endpoint.drainStop != nil {
+		close(endpoint.drainStop)
+		endpoint.drainStop = nil
+	}
+
+	endpoint.drained.Store(false)
+	slog.Info("endpoint back in rotation", "endpoint", endpoint.Address)
+}
+
+func (endpoint *Endpoint) IsDraining() bool {
+	return endpoint.draining.Load()
+}
+
+// can receive new requests and new sticky sessions
+func (endpoint *Endpoint) isAvailable() bool {
+	return endpoint.Alive.Load() && !endpoint.draining.Load() && !endpoint.isEjected()
+}
+
+// can keep serving an already assigned sticky session
+func (endpoint *Endpoint) acceptsSession() bool {
+	return endpoint.Alive.Load() && !endpoint.drained.Load() && !endpoint.isEjected()
+}
+
+// endpoints with this address in every bind and group, mirrors excluded
+func (s *LoadBalancerSettings) FindEndpoints(address string) []*Endpoint {
+	var found []*Endpoint
+	for _, bind := range s.Bind {
+		for _, group := range bind.Groups {
+			for _, endpoint := range group.Endpoints {
+				if endpoint.Address == address {
+					found = append(found, endpoint)
+				}
+			}
+		}
+	}
+	return found
+}
+
+// applies the draining flags of a reloaded configuration to the running one,
+// binds, groups and endpoints are matched by address (and path for groups)
+func (s *LoadBalancerSettings) applyDrainState(reloaded *LoadBalancerSettings) {
+	for _, reloadedBind := range reloaded.Bind {
+		for _, bind := range s.Bind {
+			if bind.Address != reloadedBind.Address {
+				continue
+			}
+
+			for _, reloadedGroup := range reloadedBind.Groups {
+				for _, group := range bind.Groups {
+					if group.Address != reloadedGroup.Address || group.Path != reloadedGroup.Path {
+						continue
+					}
+
+					for _, reloadedEndpoint := range reloadedGroup.Endpoints {
+						for _, endpoint := range group.Endpoints {
+							if endpoint.Address != reloadedEndpoint.Address {
+								continue
+							}
+
+							endpoint.DrainTimeout = reloadedEndpoint.DrainTimeout
+							if reloadedEndpoint.Draining {
+								endpoint.Drain()
+							} else {
+								endpoint.Undrain()
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
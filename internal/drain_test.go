@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, timeout time.Duration, condition func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return condition()
+}
+
+func aliveEndpoint(address string) *Endpoint {
+	endpoint := &Endpoint{Address: address}
+	endpoint.Alive.Store(true)
+	return endpoint
+}
+
+func TestDrainTimeout(t *testing.T) {
+	endpoint := aliveEndpoint("http://a")
+	endpoint.DrainTimeout = "20ms"
+	endpoint.ActiveConnections.Add(1)
+
+	endpoint.Drain()
+	if endpoint.isAvailable() {
+		t.Error("a draining endpoint must not take new requests")
+	}
+	if !endpoint.acceptsSession() {
+		t.Error("a draining endpoint keeps serving its sessions until drained")
+	}
+
+	if !waitFor(t, time.Second, func() bool { return !endpoint.acceptsSession() }) {
+		t.Fatal("endpoint not drained after the timeout")
+	}
+
+	endpoint.Undrain()
+	if !endpoint.isAvailable() || !endpoint.acceptsSession() {
+		t.Error("an undrained endpoint must be back in rotation")
+	}
+}
+
+func TestDrainWithoutConnections(t *testing.T) {
+	endpoint := aliveEndpoint("http://a")
+	endpoint.Drain()
+
+	if !waitFor(t, drainPollInterval+drainIdleGrace+time.Second, func() bool { return endpoint.drained.Load() }) {
+		t.Fatal("endpoint without connections not drained")
+	}
+}
+
+func TestDrainIdleGrace(t *testing.T) {
+	endpoint := aliveEndpoint("http://a")
+	endpoint.Drain()
+
+	//a request starting while the watcher already saw the endpoint idle
+	time.Sleep(drainPollInterval + drainPollInterval/5)
+	endpoint.ActiveConnections.Add(1)
+	time.Sleep(drainIdleGrace)
+	if endpoint.drained.Load() {
+		t.Fatal("endpoint drained with a request in flight")
+	}
+
+	endpoint.ActiveConnections.Add(^uint64(0))
+	time.Sleep(drainPollInterval + drainPollInterval/5)
+	if endpoint.drained.Load() {
+		t.Error("endpoint drained before staying idle for the grace period")
+	}
+	if !waitFor(t, drainPollInterval+drainIdleGrace+time.Second, func() bool { return endpoint.drained.Load() }) {
+		t.Fatal("idle endpoint not drained after the grace period")
+	}
+}
+
+func TestUndrainStopsWatcher(t *testing.T) {
+	endpoint := aliveEndpoint("http://a")
+	endpoint.DrainTimeout = "10ms"
+
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			endpoint.Drain()
+		}()
+		go func() {
+			defer wg.Done()
+			endpoint.Undrain()
+		}()
+	}
+	wg.Wait()
+	endpoint.Undrain()
+
+	time.Sleep(50 * time.Millisecond)
+	if endpoint.IsDraining() || endpoint.drained.Load() {
+		t.Error("a watcher of a previous drain marked the undrained endpoint")
+	}
+}
+
+func TestApplyDrainState(t *testing.T) {
+	endpoint := aliveEndpoint("http://a")
+	other := aliveEndpoint("http://b")
+	running := &LoadBalancerSettings{Bind: []*Bind{{
+		Address: ":80",
+		Groups:  []*Group{{Address: "example.com", Path: "/", Endpoints: []*Endpoint{endpoint, other}}},
+	}}}
+
+	reloaded := &LoadBalancerSettings{Bind: []*Bind{{
+		Address: ":80",
+		Groups: []*Group{{Address: "example.com", Path: "/", Endpoints: []*Endpoint{
+			{Address: "http://a", Draining: true, DrainTimeout: "1m"},
+		}}},
+	}}}
+
+	running.applyDrainState(reloaded)
+	if !endpoint.IsDraining() || endpoint.DrainTimeout != "1m" {
+		t.Error("the reloaded draining flag was not applied")
+	}
+	if other.IsDraining() {
+		t.Error("an endpoint missing from the reloaded configuration must not change")
+	}
+
+	reloaded.Bind[0].Groups[0].Endpoints[0].Draining = false
+	running.applyDrainState(reloaded)
+	if endpoint.IsDraining() {
+		t.Error("the endpoint was not undrained")
+	}
+}
@@ -1,11 +1,7 @@
 package internal
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha1"
-	"crypto/tls"
-	"encoding/base64"
 	"errors"
 	"log/slog"
 	"net"
@@ -13,6 +9,7 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -30,51 +27,135 @@ type Endpoint struct {
 	Address string `json:"address"`
 
 	TLSInsecureSkipVerify bool `json:"tlsInsecureSkipVerify"`
+	//h1 (default), h2, h2c or h3, see newTransport
+	UpstreamProtocol string `json:"upstreamProtocol,omitempty"`
+	//h3 only: GET and HEAD sent as 0-RTT early data, they can be replayed by an attacker
+	Upstream0RTT bool `json:"upstream0RTT,omitempty"`
+	//h3 only: protocol used when QUIC cannot be reached, h1 (default), h2 or none
+	H3Fallback string `json:"h3Fallback,omitempty"`
+
+	//relative share of requests for balancing algorithms honouring weights, default 1.
+	//0 takes no new requests while an endpoint with a positive weight is available
+	Weight *int `json:"weight,omitempty"`
 
 	// proxy parameters
 	ProxyPass     string `json:"proxyPass"`
 	ProxyRedirect bool   `json:"proxyRedirect"`
 
+	// drain parameters, can be changed at runtime by reloading the configuration (SIGHUP)
+	Draining     bool   `json:"draining,omitempty"`
+	DrainTimeout string `json:"drainTimeout,omitempty"`
+
 	ActiveConnections atomic.Uint64          `json:"-"`
 	Alive             atomic.Bool            `json:"-"`
 	ReverseProxy      *httputil.ReverseProxy `json:"-"`
 
 	//used for persistent session
-	Signature string `json:"-"`
+	sessionID []byte `json:"-"`
+
+	//read without lock, written under drainMu together with drainStop
+	draining  atomic.Bool   `json:"-"`
+	drained   atomic.Bool   `json:"-"`
+	drainMu   sync.Mutex    `json:"-"`
+	drainStop chan struct{} `json:"-"`
+
+	//slow start window of the group and unix nano time of the last recovery
+	slowStart  time.Duration `json:"-"`
+	aliveSince atomic.Int64  `json:"-"`
+
+	//nil when the group has no outlier detection
+	outliers *outlierStats `json:"-"`
+	//nil when the group is not balanced by latency
+	latency *ewmaStats `json:"-"`
+	//nil for the default tcp check
+	healthCheck *HealthCheck `json:"-"`
+	//latency is measured up to the response headers, the body may last forever
+	streaming bool `json:"-"`
+	//tcp or udp when the endpoint is served by a raw bind
+	network string `json:"-"`
+	//udp endpoints only, resolved by every health check so new flows never wait on DNS
+	udpAddr atomic.Pointer[net.UDPAddr] `json:"-"`
 }
 
 func (endpoint *Endpoint) HealthCheck() {
-	url, err := url.Parse(endpoint.Address)
-
-	if err != nil {
-		slog.Info("Error parsing healthcheck url: ", "error", err)
+	if check := endpoint.healthCheck; check != nil && check.Type == HEALTH_CHECK_GRPC {
+		err := endpoint.grpcHealthCheck(check)
+		if err != nil {
+			slog.Debug("gRPC health check failed", "endpoint", endpoint.Address, "error", err)
+		}
+		endpoint.setAlive(err == nil)
 		return
 	}
 
-	host := url.Host
-	if !strings.Contains(host, ":") {
-		switch url.Scheme {
-		case "http":
-			host += ":80"
-		case "https":
-			host += ":443"
+	if endpoint.network == PROTO_UDP {
+		if err := endpoint.resolveUDP(); err != nil {
+			slog.Debug("cannot resolve udp endpoint", "endpoint", endpoint.Address, "error", err)
+			endpoint.setAlive(false)
+			return
+		}
+		if check := endpoint.healthCheck; check == nil || check.Type != HEALTH_CHECK_TCP {
+			err := endpoint.udpHealthCheck(check)
+			if err != nil {
+				slog.Debug("udp health check failed", "endpoint", endpoint.Address, "error", err)
+			}
+			endpoint.setAlive(err == nil)
+			return
 		}
 	}
 
+	host, err := endpoint.hostPort()
+
+	if err != nil {
+		slog.Info("Error parsing healthcheck url: ", "error", err)
+		return
+	}
+
 	conn, err := net.DialTimeout("tcp", host, 5*time.Second)
 	if err != nil {
-		endpoint.Alive.Store(false)
+		endpoint.setAlive(false)
 	} else {
-		endpoint.Alive.Store(true)
+		endpoint.setAlive(true)
 		defer conn.Close()
 	}
 
 }
 
+func (endpoint *Endpoint) Addr() string {
+	return endpoint.Address
+}
+
+func (endpoint *Endpoint) InFlight() uint64 {
+	return endpoint.ActiveConnections.Load()
+}
+
 func (endpoint *Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	endpoint.ActiveConnections.Add(1)
-	endpoint.ReverseProxy.ServeHTTP(w, r)
-	endpoint.ActiveConnections.Swap(endpoint.ActiveConnections.Load() - 1)
+	defer endpoint.ActiveConnections.Add(^uint64(0))
+
+	if endpoint.outliers == nil && endpoint.latency == nil {
+		endpoint.ReverseProxy.ServeHTTP(w, r)
+		return
+	}
+
+	rec := &statusRecorder{ResponseWriter: w}
+	start := time.Now()
+	endpoint.ReverseProxy.ServeHTTP(rec, r)
+	elapsed := time.Since(start)
+	if endpoint.streaming && !rec.headerAt.IsZero() {
+		elapsed = rec.headerAt.Sub(start)
+	}
+
+	if endpoint.outliers != nil {
+		endpoint.outliers.record(elapsed, rec.success())
+	}
+
+	if endpoint.latency != nil {
+		//a refused connection is fast, it must not make the endpoint look like the best one
+		if rec.failed {
+			elapsed = max(elapsed, peakEwmaPenalty)
+		}
+		endpoint.latency.observe(elapsed)
+	}
 }
 
 func getRetryFromContext(key contextKey, r *http.Request) int {
@@ -84,24 +165,28 @@ func getRetryFromContext(key contextKey, r *http.Request) int {
 	return 0
 }
 
-// optain the signature using the address to encrypt himself
-// it useful for stateless persistent session
-func sign(endpoint *Endpoint, group *Group) {
-	hash := sha1.New()
-	var buff bytes.Buffer
-	buff.WriteString(endpoint.Address)
-	if group.Path != "" {
-		buff.WriteString(group.Path)
+func (endpoint *Endpoint) Start(group *Group) error {
+	endpoint.sessionID = sessionID(endpoint, group)
+	endpoint.slowStart = group.slowStart
+	if _, ok := group.balance.(*peakEwma); ok {
+		endpoint.latency = &ewmaStats{stamp: time.Now()}
 	}
+	endpoint.healthCheck = group.HealthCheck
 
-	buff.WriteString(strings.Join(runningConf.Settings.PersistentSession.CookieSettings, ""))
-
-	hash.Write(buff.Bytes())
-	endpoint.Signature = base64.URLEncoding.EncodeToString(hash.Sum(nil))
-}
+	//raw traffic is sent by proxyRaw and udpServer, there is no reverse proxy to build
+	endpoint.network = group.raw
+	if group.raw != "" {
+		if _, e := endpoint.hostPort(); e != nil {
+			return e
+		}
+		//the first health check of the settings ran before the endpoint knew its network
+		endpoint.HealthCheck()
+		if endpoint.Draining {
+			endpoint.Drain()
+		}
+		return nil
+	}
 
-func (endpoint *Endpoint) Start(group *Group) error {
-	sign(endpoint, group)
 	parsedaddress, e := url.Parse(endpoint.Address)
 	if e != nil {
 		return e
@@ -109,9 +194,17 @@ func (endpoint *Endpoint) Start(group *Group) error {
 
 	proxy := httputil.NewSingleHostReverseProxy(parsedaddress)
 
-	proxy.Transport = &http.Transport{
-		//todo timouts and more...
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: endpoint.TLSInsecureSkipVerify},
+	protocol, e := endpoint.upstreamProtocol(group, parsedaddress)
+	if e != nil {
+		return e
+	}
+	proxy.Transport, e = endpoint.newTransport(protocol)
+	if e != nil {
+		return e
+	}
+	endpoint.streaming = group.Streaming
+	if group.Streaming {
+		proxy.FlushInterval = -1
 	}
 
 	if endpoint.ProxyPass != "" {
@@ -171,6 +264,19 @@ func (endpoint *Endpoint) Start(group *Group) error {
 		}
 	}
 
+	modifyResponseDefault := proxy.ModifyResponse
+	proxy.ModifyResponse = func(r *http.Response) error {
+		if modifyResponseDefault != nil {
+			if err := modifyResponseDefault(r); err != nil {
+				return err
+			}
+		}
+		if learn, ok := group.affinity.(*learnAffinity); ok {
+			learn.learn(r, endpoint)
+		}
+		return group.ErrorPages.replaceUpstreamError(r)
+	}
+
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
 
 		if errors.Is(err, context.Canceled) {
@@ -182,6 +288,10 @@ func (endpoint *Endpoint) Start(group *Group) error {
 			slog.Debug("proxy error", "error", err)
 		}
 
+		if rec, ok := w.(*statusRecorder); ok {
+			rec.failed = true
+		}
+
 		retriesSameEndp := getRetryFromContext(RETRY_SAME_ENDP, r)
 		if retriesSameEndp < maxRetry {
 			slog.Debug("retried too many times the same endpoint", "endpoint", endpoint.Address)
@@ -190,7 +300,7 @@ func (endpoint *Endpoint) Start(group *Group) error {
 			return
 		}
 
-		endpoint.Alive.Store(false)
+		endpoint.setAlive(false)
 
 		retriesAnotherEndp := getRetryFromContext(RETRY_ANOTHER_ENDP, r)
 		if retriesAnotherEndp < maxRetry {
@@ -200,10 +310,19 @@ func (endpoint *Endpoint) Start(group *Group) error {
 		}
 
 		slog.Debug("retried too many times another endpoint, giving up", "endpoint", endpoint.Address)
-		http.Error(w, "Service not available", http.StatusServiceUnavailable)
+		group.writeError(w, r, http.StatusServiceUnavailable, defaultErrorMessage)
 	}
 
 	endpoint.ReverseProxy = proxy
 
+	//the first health check of the settings ran before the transport a gRPC check goes through
+	if check := endpoint.healthCheck; check != nil && check.Type == HEALTH_CHECK_GRPC {
+		endpoint.HealthCheck()
+	}
+
+	if endpoint.Draining {
+		endpoint.Drain()
+	}
+
 	return nil
 }
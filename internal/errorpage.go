@@ -0,0 +1,276 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	htmltemplate "html/template"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+const defaultErrorMessage = "Service not available"
+
+type ErrorPages struct {
+	//keyed by status code, e.g. "503"
+	Pages map[int]*ErrorPage `json:"pages,omitempty"`
+	//replace upstream 5xx responses with the configured page for the same status code,
+	//inherited from the bind when not set
+	InterceptUpstream *bool `json:"interceptUpstream,omitempty"`
+
+	//pages of the enclosing bind, used when a status code is not configured at group level
+	parent *ErrorPages `json:"-"`
+}
+
+type ErrorPage struct {
+	//file names are relative to basePath and have precedence over inline templates
+	HtmlFilePath string `json:"htmlFileName,omitempty"`
+	HtmlTemplate string `json:"htmlTemplate,omitempty"`
+	JsonFilePath string `json:"jsonFileName,omitempty"`
+	JsonTemplate string `json:"jsonTemplate,omitempty"`
+
+	html *htmltemplate.Template `json:"-"`
+	json *texttemplate.Template `json:"-"`
+}
+
+// values available inside error page templates
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Message    string
+	RequestID  string
+	Method     string
+	Host       string
+	Path       string
+}
+
+func (page *ErrorPage) Start(basePath string, status int) error {
+	name := strconv.Itoa(status)
+
+	htmlSource, err := readTemplateSource(basePath, page.HtmlFilePath, page.HtmlTemplate)
+	if err != nil {
+		return err
+	}
+	if htmlSource != "" {
+		page.html, err = htmltemplate.New(name).Parse(htmlSource)
+		if err != nil {
+			return err
+		}
+	}
+
+	jsonSource, err := readTemplateSource(basePath, page.JsonFilePath, page.JsonTemplate)
+	if err != nil {
+		return err
+	}
+	if jsonSource != "" {
+		page.json, err = texttemplate.New(name).Parse(jsonSource)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readTemplateSource(basePath string, fileName string, inline string) (string, error) {
+	if fileName == "" {
+		return inline, nil
+	}
+
+	read, err := os.ReadFile(path.Join(basePath, fileName))
+	if err != nil {
+		return "", err
+	}
+	return string(read), nil
+}
+
+func (pages *ErrorPages) Start(basePath string) error {
+	if pages == nil {
+		return nil
+	}
+
+	for status, page := range pages.Pages {
+		if err := page.Start(basePath, status); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// returns the group pages chained to the bind ones, or the bind ones if the group has none
+func (pages *ErrorPages) inherit(parent *ErrorPages) *ErrorPages {
+	if pages == nil {
+		return parent
+	}
+	pages.parent = parent
+	return pages
+}
+
+func (pages *ErrorPages) lookup(status int) *ErrorPage {
+	for p := pages; p != nil; p = p.parent {
+		if page, ok := p.Pages[status]; ok {
+			return page
+		}
+	}
+	return nil
+}
+
+// the nearest explicit value wins, so a group can turn off the interception of its bind
+func (pages *ErrorPages) interceptUpstream() bool {
+	for p := pages; p != nil; p = p.parent {
+		if p.InterceptUpstream != nil {
+			return *p.InterceptUpstream
+		}
+	}
+	return false
+}
+
+// true when a page is configured at any level, otherwise errors keep the plain text body
+func (pages *ErrorPages) configured() bool {
+	for p := pages; p != nil; p = p.parent {
+		if len(p.Pages) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// true when the client explicitly prefers application/json over text/html
+func prefersJSON(r *http.Request) bool {
+	var htmlQ, jsonQ float64 = -1, -1
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(qs, 64); err == nil {
+				q = parsed
+			}
+		}
+
+		switch mediaType {
+		case "application/json":
+			jsonQ = max(jsonQ, q)
+		case "text/html", "*/*":
+			htmlQ = max(htmlQ, q)
+		}
+	}
+
+	return jsonQ > 0 && jsonQ > htmlQ
+}
+
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// renders the configured page for status, ok is false when nothing is configured
+// for the negotiated content type
+func (pages *ErrorPages) render(r *http.Request, status int, message string) (contentType string, body []byte, ok bool) {
+	data := errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+		RequestID:  requestID(r),
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+	}
+
+	var buffer bytes.Buffer
+	page := pages.lookup(status)
+	wantsJSON := prefersJSON(r)
+
+	switch {
+	case page != nil && wantsJSON && page.json != nil:
+		if err := page.json.Execute(&buffer, data); err != nil {
+			slog.Error("error executing json error page", "status", status, "error", err)
+			return "", nil, false
+		}
+		return "application/json; charset=utf-8", buffer.Bytes(), true
+	case page != nil && !wantsJSON && page.html != nil:
+		if err := page.html.Execute(&buffer, data); err != nil {
+			slog.Error("error executing html error page", "status", status, "error", err)
+			return "", nil, false
+		}
+		return "text/html; charset=utf-8", buffer.Bytes(), true
+	case wantsJSON:
+		err := json.NewEncoder(&buffer).Encode(map[string]any{
+			"status":    data.Status,
+			"message":   data.Message,
+			"requestId": data.RequestID,
+		})
+		if err != nil {
+			return "", nil, false
+		}
+		return "application/json; charset=utf-8", buffer.Bytes(), true
+	}
+
+	return "", nil, false
+}
+
+// replacement of http.Error for every error generated by the balancer itself
+func (pages *ErrorPages) writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if isGRPCRequest(r) {
+		writeGRPCError(w, status, message)
+		return
+	}
+
+	if !pages.configured() {
+		http.Error(w, message, status)
+		return
+	}
+
+	contentType, body, ok := pages.render(r, status, message)
+	if !ok {
+		http.Error(w, message, status)
+		return
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// used as part of ReverseProxy.ModifyResponse, replaces the upstream 5xx body
+// only when a page is configured for that status code
+func (pages *ErrorPages) replaceUpstreamError(resp *http.Response) error {
+	if resp.StatusCode < 500 || !pages.interceptUpstream() || pages.lookup(resp.StatusCode) == nil {
+		return nil
+	}
+
+	contentType, body, ok := pages.render(resp.Request, resp.StatusCode, http.StatusText(resp.StatusCode))
+	if !ok {
+		return nil
+	}
+
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Set("Content-Type", contentType)
+
+	return nil
+}
@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func startErrorPages(t *testing.T, pages *ErrorPages, basePath string) *ErrorPages {
+	t.Helper()
+	if err := pages.Start(basePath); err != nil {
+		t.Fatalf("starting error pages: %v", err)
+	}
+	return pages
+}
+
+func TestErrorPageNegotiation(t *testing.T) {
+	pages := startErrorPages(t, &ErrorPages{Pages: map[int]*ErrorPage{
+		503: {
+			HtmlTemplate: `<p>{{.Status}} {{.StatusText}} {{.RequestID}} {{.Path}}</p>`,
+			JsonTemplate: `{"code":{{.Status}},"id":"{{.RequestID}}"}`,
+		},
+	}}, t.TempDir())
+
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"browser", "text/html,application/xhtml+xml,*/*;q=0.8", "text/html; charset=utf-8", "<p>503 Service Unavailable abc /shop</p>"},
+		{"no accept", "", "text/html; charset=utf-8", "<p>503 Service Unavailable abc /shop</p>"},
+		{"json", "application/json", "application/json; charset=utf-8", `{"code":503,"id":"abc"}`},
+		{"json preferred", "text/html;q=0.5, application/json", "application/json; charset=utf-8", `{"code":503,"id":"abc"}`},
+		{"html preferred", "text/html, application/json;q=0.9", "text/html; charset=utf-8", "<p>503 Service Unavailable abc /shop</p>"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/shop", nil)
+			r.Header.Set("X-Request-Id", "abc")
+			if test.accept != "" {
+				r.Header.Set("Accept", test.accept)
+			}
+
+			w := httptest.NewRecorder()
+			pages.writeError(w, r, http.StatusServiceUnavailable, defaultErrorMessage)
+
+			if w.Code != http.StatusServiceUnavailable {
+				t.Errorf("status = %d, want 503", w.Code)
+			}
+			if got := w.Header().Get("Content-Type"); got != test.contentType {
+				t.Errorf("content type = %q, want %q", got, test.contentType)
+			}
+			if got := w.Body.String(); got != test.body {
+				t.Errorf("body = %q, want %q", got, test.body)
+			}
+		})
+	}
+}
+
+func TestErrorPageHTMLEscaping(t *testing.T) {
+	pages := startErrorPages(t, &ErrorPages{Pages: map[int]*ErrorPage{
+		503: {HtmlTemplate: `<p>{{.Path}}</p>`},
+	}}, t.TempDir())
+
+	r := httptest.NewRequest(http.MethodGet, "/%3Cscript%3E", nil)
+	w := httptest.NewRecorder()
+	pages.writeError(w, r, http.StatusServiceUnavailable, defaultErrorMessage)
+
+	if body := w.Body.String(); strings.Contains(body, "<script>") {
+		t.Errorf("path not escaped: %q", body)
+	}
+}
+
+func TestErrorPageFallbacks(t *testing.T) {
+	pages := startErrorPages(t, &ErrorPages{Pages: map[int]*ErrorPage{
+		503: {HtmlTemplate: `<p>down</p>`},
+	}}, t.TempDir())
+
+	t.Run("status not configured", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		pages.writeError(w, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusInternalServerError, defaultErrorMessage)
+		if got := w.Body.String(); got != defaultErrorMessage+"\n" {
+			t.Errorf("body = %q, want the plain text message", got)
+		}
+	})
+
+	t.Run("json without template", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", "application/json")
+		r.Header.Set("X-Request-Id", "abc")
+		w := httptest.NewRecorder()
+		pages.writeError(w, r, http.StatusServiceUnavailable, defaultErrorMessage)
+
+		var body map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("body is not json: %q", w.Body.String())
+		}
+		if body["status"] != float64(503) || body["message"] != defaultErrorMessage || body["requestId"] != "abc" {
+			t.Errorf("unexpected json body %v", body)
+		}
+	})
+
+	t.Run("nil pages", func(t *testing.T) {
+		var none *ErrorPages
+		w := httptest.NewRecorder()
+		none.writeError(w, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusServiceUnavailable, defaultErrorMessage)
+		if w.Code != http.StatusServiceUnavailable || w.Body.String() != defaultErrorMessage+"\n" {
+			t.Errorf("got %d %q", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("json without pages", func(t *testing.T) {
+		for _, none := range []*ErrorPages{nil, {}} {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept", "application/json")
+			w := httptest.NewRecorder()
+			none.writeError(w, r, http.StatusServiceUnavailable, defaultErrorMessage)
+			if w.Body.String() != defaultErrorMessage+"\n" || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+				t.Errorf("without pages the body must stay plain text, got %q %q", w.Header().Get("Content-Type"), w.Body.String())
+			}
+		}
+	})
+}
+
+func TestErrorPageInheritance(t *testing.T) {
+	bind := startErrorPages(t, &ErrorPages{Pages: map[int]*ErrorPage{
+		500: {HtmlTemplate: `bind 500`},
+		503: {HtmlTemplate: `bind 503`},
+	}}, t.TempDir())
+	group := startErrorPages(t, &ErrorPages{Pages: map[int]*ErrorPage{
+		503: {HtmlTemplate: `group 503`},
+	}}, t.TempDir()).inherit(bind)
+
+	for status, want := range map[int]string{500: "bind 500", 503: "group 503"} {
+		w := httptest.NewRecorder()
+		group.writeError(w, httptest.NewRequest(http.MethodGet, "/", nil), status, defaultErrorMessage)
+		if got := w.Body.String(); got != want {
+			t.Errorf("status %d: body = %q, want %q", status, got, want)
+		}
+	}
+
+	var none *ErrorPages
+	if none.inherit(bind) != bind {
+		t.Error("a group without pages must use the bind ones")
+	}
+}
+
+func TestErrorPageFromFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "503.html"), []byte(`file {{.Status}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := startErrorPages(t, &ErrorPages{Pages: map[int]*ErrorPage{
+		503: {HtmlFilePath: "503.html", HtmlTemplate: "inline"},
+	}}, dir)
+
+	w := httptest.NewRecorder()
+	pages.writeError(w, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusServiceUnavailable, defaultErrorMessage)
+	if got := w.Body.String(); got != "file 503" {
+		t.Errorf("body = %q, the file must have precedence over the inline template", got)
+	}
+
+	missing := &ErrorPages{Pages: map[int]*ErrorPage{503: {HtmlFilePath: "missing.html"}}}
+	if err := missing.Start(dir); err == nil {
+		t.Error("a missing page file must fail the start")
+	}
+}
+
+func TestReplaceUpstreamError(t *testing.T) {
+	pages := startErrorPages(t, &ErrorPages{
+		InterceptUpstream: ptr(true),
+		Pages:             map[int]*ErrorPage{502: {HtmlTemplate: `replaced {{.Status}}`}},
+	}, t.TempDir())
+
+	upstream := func(status int) *http.Response {
+		header := http.Header{}
+		header.Set("Content-Encoding", "gzip")
+		return &http.Response{
+			StatusCode: status,
+			Header:     header,
+			Body:       io.NopCloser(strings.NewReader("upstream body")),
+			Request:    httptest.NewRequest(http.MethodGet, "/", nil),
+		}
+	}
+
+	resp := upstream(http.StatusBadGateway)
+	if err := pages.replaceUpstreamError(resp); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "replaced 502" || resp.ContentLength != int64(len(body)) || resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("upstream error not replaced: %q, length %d, encoding %q", body, resp.ContentLength, resp.Header.Get("Content-Encoding"))
+	}
+
+	for _, status := range []int{http.StatusOK, http.StatusNotFound, http.StatusServiceUnavailable} {
+		resp := upstream(status)
+		pages.replaceUpstreamError(resp)
+		if body, _ := io.ReadAll(resp.Body); string(body) != "upstream body" {
+			t.Errorf("status %d replaced without a configured page", status)
+		}
+	}
+}
+
+func TestInterceptUpstreamInheritance(t *testing.T) {
+	tests := []struct {
+		name  string
+		bind  *bool
+		group *bool
+		want  bool
+	}{
+		{"unset", nil, nil, false},
+		{"bind enabled", ptr(true), nil, true},
+		{"group disables bind", ptr(true), ptr(false), false},
+		{"group enables", ptr(false), ptr(true), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bind := &ErrorPages{InterceptUpstream: test.bind}
+			group := (&ErrorPages{InterceptUpstream: test.group}).inherit(bind)
+			if got := group.interceptUpstream(); got != test.want {
+				t.Errorf("interceptUpstream() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func ptr[T any](value T) *T {
+	return &value
+}
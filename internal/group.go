@@ -2,29 +2,76 @@ package internal
 
 import (
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"strings"
-)
+	"sync/atomic"
+	"time"
 
-type balance interface {
-	balanced(endpoints []*Endpoint, obj any) (*Endpoint, error)
-}
+	"minibalancer/balancer"
+)
 
 const (
 	ROUND_ROBIN = "roundrobin"
 	FAILOVER    = "failover"
+	PEAK_EWMA   = "peakewma"
+	RANDOM      = "random"
+	P2C         = "p2c"
 )
 
+// built-in algorithms, custom ones are registered by the user through the balancer package
+func init() {
+	balancer.Register(ROUND_ROBIN, func() balancer.Balancer { return &roundRobin{} })
+	balancer.Register(FAILOVER, func() balancer.Balancer { return &failover{} })
+	balancer.Register(PEAK_EWMA, func() balancer.Balancer { return &peakEwma{} })
+	balancer.Register(RANDOM, func() balancer.Balancer { return &random{} })
+	balancer.Register(P2C, func() balancer.Balancer { return &powerOfTwoChoices{} })
+}
+
 type Group struct {
 	Address            string      `json:"address"`
 	Path               string      `json:"path"`
 	SessionPersistence bool        `json:"sessionPersistence"`
 	Endpoints          []*Endpoint `json:"endpoints"`
 	Algorithm          string      `json:"algorithm"`
+	ErrorPages         *ErrorPages `json:"errorPages,omitempty"`
+	//window during which a recovered endpoint ramps up to its full weight, e.g. "30s"
+	SlowStart        string            `json:"slowStart,omitempty"`
+	OutlierDetection *OutlierDetection `json:"outlierDetection,omitempty"`
+	//overrides sessionPersistence, allowing source ip and application cookie stickiness
+	Stickiness *Stickiness `json:"stickiness,omitempty"`
+	//client certificate requirement, the certificate is verified by the bind clientAuth
+	ClientCert *GroupClientCert `json:"clientCert,omitempty"`
+	//gRPC traffic: HTTP/2 to the endpoints and errors as grpc-status
+	GRPC        bool         `json:"grpc,omitempty"`
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty"`
+	//WebSocket and other upgraded connections
+	Upgrade *Upgrade `json:"upgrade,omitempty"`
+	//long lived responses, see prepareStreaming
+	Streaming bool `json:"streaming,omitempty"`
+	//copy of the requests sent to other endpoints, see Mirror
+	Mirror *Mirror `json:"mirror,omitempty"`
+	//TLS is not terminated, connections whose SNI matches the address are spliced to
+	//the endpoints. Allowed on HTTP and tcp binds, see passthroughListener
+	TLSPassthrough bool `json:"tlsPassthrough,omitempty"`
+	//connection settings when the group is served by a tcp or udp bind, or is tlsPassthrough
+	Layer4 *Layer4 `json:"layer4,omitempty"`
 
-	//field used for balancing function, currently only roundrobin
-	balance `json:"-"`
+	//balancing algorithm resolved by name from the balancer registry
+	balance   balancer.Balancer `json:"-"`
+	slowStart time.Duration     `json:"-"`
+	conf      *Conf             `json:"-"`
+	//nil when the group has no session persistence
+	affinity        sessionAffinity `json:"-"`
+	failoverPolicy  string          `json:"-"`
+	migrationHeader string          `json:"-"`
+	//upgraded connections currently open, limited by maxUpgrades when not 0
+	upgradeIdleTimeout time.Duration `json:"-"`
+	maxUpgrades        int64         `json:"-"`
+	upgrades           atomic.Int64  `json:"-"`
+	//tcp or udp, set by the bind when the group is served raw traffic instead of HTTP requests
+	raw string `json:"-"`
 }
 
 func (group *Group) isPathCompliant(r *http.Request) bool {
@@ -32,72 +79,170 @@ func (group *Group) isPathCompliant(r *http.Request) bool {
 }
 
 func (group *Group) handleRequest(w http.ResponseWriter, r *http.Request) {
+	if group.ClientCert != nil && !group.ClientCert.allowed(r) {
+		slog.Debug("client certificate missing or not allowed", "group", group.Path)
+		group.writeError(w, r, http.StatusForbidden, "Client certificate required")
+		return
+	}
+
+	if isUpgradeRequest(r) {
+		if !group.acquireUpgrade(r) {
+			slog.Debug("too many upgraded connections", "group", group.Path)
+			group.writeError(w, r, http.StatusServiceUnavailable, "Too many upgraded connections")
+			return
+		}
+		defer group.releaseUpgrade(r)
+	}
+
+	//retries on another endpoint were already mirrored
+	if group.Mirror != nil && getRetryFromContext(RETRY_ANOTHER_ENDP, r) == 0 {
+		defer group.Mirror.mirror(r)()
+	}
+
 	endpoints := group.Endpoints
-	if group.SessionPersistence {
+	if group.affinity != nil {
+		if group.migrationHeader != "" {
+			r.Header.Del(group.migrationHeader)
+		}
 
-		var chosenEndp *Endpoint
-		var e error
+		chosenEndp, e := group.affinity.get(r, endpoints)
+		switch {
+		case e != nil:
+			slog.Debug("persistent session not found", "reason", e)
+			chosenEndp, e = group.getBalancedEndpoint(r, endpoints)
 
-		chosenEndp, e = runningConf.Settings.PersistentSession.get(r, endpoints)
-		if e != nil || !chosenEndp.Alive.Load() {
-			slog.Debug("persistent session not found or chosen endpoint is not alive")
-			chosenEndp, e = group.getBalancedEndpoint(endpoints)
+			if e != nil {
+				group.writeError(w, r, http.StatusServiceUnavailable, defaultErrorMessage)
+				return
+			}
+			group.affinity.set(w, r, chosenEndp)
+		case !chosenEndp.acceptsSession():
+			slog.Debug("persistent session endpoint is not available", "endp", chosenEndp.Address)
+			chosenEndp, e = group.migrateSession(w, r, chosenEndp)
 
 			if e != nil {
-				http.Error(w, "Service not available", http.StatusServiceUnavailable)
+				group.writeError(w, r, http.StatusServiceUnavailable, defaultErrorMessage)
 				return
 			}
-			runningConf.Settings.PersistentSession.setCookie(w, group, chosenEndp)
+		case group.failoverPolicy == FAILOVER_RETURN_WHEN_HEALTHY:
+			if fallback := group.affinity.getFallback(r, endpoints); fallback != nil {
+				slog.Info("session returned to its endpoint", "group", group.Path, "from", fallback.Address, "to", chosenEndp.Address)
+				group.affinity.setFallback(w, r, nil)
+				if group.migrationHeader != "" {
+					r.Header.Set(group.migrationHeader, "true")
+					w.Header().Set(group.migrationHeader, "true")
+				}
+			}
 		}
 
 		slog.Debug("chosen endppoint", "endp", chosenEndp.Address)
-		chosenEndp.ServeHTTP(w, r)
+		group.serve(w, r, chosenEndp)
 	} else {
-		chosenEndp, e := group.getBalancedEndpoint(endpoints)
+		chosenEndp, e := group.getBalancedEndpoint(r, endpoints)
 		if e != nil {
-			http.Error(w, "Service not available", http.StatusServiceUnavailable)
+			group.writeError(w, r, http.StatusServiceUnavailable, defaultErrorMessage)
 			return
 		}
 
 		slog.Debug("chosen endppoint", "endp", chosenEndp.Address)
 
-		chosenEndp.ServeHTTP(w, r)
+		group.serve(w, r, chosenEndp)
+	}
+}
+
+func (group *Group) serve(w http.ResponseWriter, r *http.Request, endpoint *Endpoint) {
+	if isUpgradeRequest(r) {
+		group.serveUpgrade(w, r, endpoint)
+		return
+	}
+	if group.Streaming {
+		group.prepareStreaming(w)
 	}
+	endpoint.ServeHTTP(w, r)
 }
 
-func (group *Group) getBalancedEndpoint(endpoints []*Endpoint) (*Endpoint, error) {
+func (group *Group) getBalancedEndpoint(r *http.Request, endpoints []*Endpoint) (*Endpoint, error) {
 	switch len(endpoints) {
 	case 0:
 		return nil, errors.New("no endpoints available")
 	case 1:
 		{
 			endpoint := endpoints[0]
-			if endpoint.Alive.Load() {
+			if endpoint.isAvailable() {
 				return endpoint, nil
 			}
 
 			return nil, errors.New("the only endpoint available is unreachable")
 		}
 	default:
-		return group.balance.balanced(endpoints, nil)
+		healthy := make([]balancer.Endpoint, 0, len(endpoints))
+		for _, endpoint := range endpoints {
+			if endpoint.isAvailable() {
+				healthy = append(healthy, endpoint)
+			}
+		}
+
+		if len(healthy) == 0 {
+			return nil, balancer.ErrNoEndpoint
+		}
+
+		chosen, e := group.balance.Balance(r, healthy)
+		if e != nil {
+			return nil, e
+		}
+
+		//custom balancers could return something that is not one of the endpoints
+		endpoint, ok := chosen.(*Endpoint)
+		if !ok || endpoint == nil {
+			return nil, fmt.Errorf("balancing algorithm %q returned an unknown endpoint", group.Algorithm)
+		}
+		return endpoint, nil
 	}
 }
 
-func (group *Group) initBalancing() {
-	switch strings.ToLower(group.Algorithm) {
-	case ROUND_ROBIN:
-		group.balance = &roundRobin{}
-	case FAILOVER:
-		group.balance = &failover{}
-	default:
-		group.balance = &roundRobin{}
+func (group *Group) initBalancing() error {
+	name := group.Algorithm
+	if name == "" {
+		name = ROUND_ROBIN
+	}
+
+	b, err := balancer.New(name)
+	if err != nil {
+		return err
 	}
+	group.balance = b
+	return nil
 }
 
-func (group *Group) Start() error {
+func (group *Group) Start(conf *Conf) error {
+	group.conf = conf
+
+	if err := group.ErrorPages.Start(conf.BasePath); err != nil {
+		return err
+	}
+
+	if group.HealthCheck != nil {
+		if err := group.HealthCheck.Start(); err != nil {
+			return err
+		}
+	}
 
 	//initializing load balancing algorithm
-	group.initBalancing()
+	if err := group.initBalancing(); err != nil {
+		return err
+	}
+	group.slowStart = getWithDefaultDuration(group.SlowStart, 0)
+	group.initUpgrade()
+
+	if err := group.initAffinity(); err != nil {
+		return err
+	}
+
+	if group.raw != "" {
+		if err := group.initLayer4(); err != nil {
+			return err
+		}
+	}
 
 	for _, endpoint := range group.Endpoints {
 		if e := endpoint.Start(group); e != nil {
@@ -105,5 +250,41 @@ func (group *Group) Start() error {
 		}
 	}
 
+	if group.OutlierDetection != nil {
+		group.OutlierDetection.Start(group)
+	}
+
+	if group.Mirror != nil {
+		if err := group.Mirror.Start(group, conf); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
+
+// errors generated by the balancer for requests of the group
+func (group *Group) writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if group.GRPC {
+		writeGRPCError(w, status, message)
+		return
+	}
+	group.ErrorPages.writeError(w, r, status, message)
+}
+
+// true when the balancer injected cookie is used
+func (group *Group) usesSessionCookie() bool {
+	if group.Stickiness != nil {
+		return strings.EqualFold(group.Stickiness.Mode, STICKY_COOKIE)
+	}
+	return group.SessionPersistence
+}
+
+func (group *Group) Stop() {
+	if group.OutlierDetection != nil {
+		group.OutlierDetection.Stop()
+	}
+	if group.Mirror != nil {
+		group.Mirror.Stop()
+	}
+}
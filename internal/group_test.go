@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"minibalancer/balancer"
+)
+
+// endpoint implemented outside of the group
+type foreignEndpoint struct{}
+
+func (foreignEndpoint) Addr() string             { return "foreign" }
+func (foreignEndpoint) InFlight() uint64         { return 0 }
+func (foreignEndpoint) EffectiveWeight() float64 { return 1 }
+
+// balancer choosing the last endpoint, or returning something else than one of them
+type lastEndpoint struct {
+	foreign bool
+}
+
+func (b *lastEndpoint) Balance(_ *http.Request, endpoints []balancer.Endpoint) (balancer.Endpoint, error) {
+	if b.foreign {
+		return foreignEndpoint{}, nil
+	}
+	return endpoints[len(endpoints)-1], nil
+}
+
+// registered once, the registry is process wide and tests can run several times
+func init() {
+	balancer.Register("test-last", func() balancer.Balancer { return &lastEndpoint{} })
+}
+
+func TestCustomAlgorithm(t *testing.T) {
+	a, b, down := weightedEndpoint("a", 1), weightedEndpoint("b", 1), &Endpoint{Address: "down"}
+	group := &Group{Algorithm: "test-last", Endpoints: []*Endpoint{a, b, down}}
+	if err := group.initBalancing(); err != nil {
+		t.Fatal(err)
+	}
+
+	//the balancer only receives healthy endpoints
+	chosen, err := group.getBalancedEndpoint(nil, group.Endpoints)
+	if err != nil || chosen != b {
+		t.Errorf("chosen %v, %v, want b", chosen, err)
+	}
+
+	group.balance = &lastEndpoint{foreign: true}
+	if _, err := group.getBalancedEndpoint(nil, group.Endpoints); err == nil {
+		t.Error("endpoint unknown to the group accepted")
+	}
+
+	a.Alive.Store(false)
+	b.Alive.Store(false)
+	if _, err := group.getBalancedEndpoint(nil, group.Endpoints); !errors.Is(err, balancer.ErrNoEndpoint) {
+		t.Errorf("error = %v, want %v", err, balancer.ErrNoEndpoint)
+	}
+}
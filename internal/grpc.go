@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// subset of the gRPC status codes, see https://grpc.io/docs/guides/status-codes/
+const (
+	grpcUnknown          = 2
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+const (
+	HEALTH_CHECK_TCP  = "tcp"
+	HEALTH_CHECK_GRPC = "grpc"
+	HEALTH_CHECK_UDP  = "udp"
+
+	DefaultHealthCheckTimeout time.Duration = 5 * time.Second
+
+	grpcHealthCheckPath = "/grpc.health.v1.Health/Check"
+	//grpc.health.v1.HealthCheckResponse.ServingStatus
+	grpcServing = 1
+	//a health response is a single enum, anything bigger is not a health response
+	maxGRPCHealthResponseSize = 1 << 10
+)
+
+// active health check of the group endpoints, tcp (default) only dials the endpoint
+// while grpc implements grpc.health.v1.Health/Check. udp probes the endpoint port of udp
+// binds with an empty datagram, see udpHealthCheck
+type HealthCheck struct {
+	Type string `json:"type,omitempty"`
+	//service name sent in the grpc check, empty checks the whole server
+	Service string `json:"service,omitempty"`
+	Timeout string `json:"timeout,omitempty"`
+
+	timeout time.Duration `json:"-"`
+}
+
+func (check *HealthCheck) Start() error {
+	check.Type = strings.ToLower(check.Type)
+	switch check.Type {
+	case "", HEALTH_CHECK_TCP, HEALTH_CHECK_GRPC, HEALTH_CHECK_UDP:
+	default:
+		return fmt.Errorf("unknown health check type %q", check.Type)
+	}
+	check.timeout = getWithDefaultDuration(check.Timeout, DefaultHealthCheckTimeout)
+	return nil
+}
+
+func isGRPCRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+func grpcStatusFromHTTP(status int) int {
+	//as mapped by gRPC clients receiving a non gRPC response, see
+	//https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md
+	switch status {
+	case http.StatusBadRequest, http.StatusInternalServerError:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return grpcUnavailable
+	}
+	return grpcUnknown
+}
+
+// trailers-only response, gRPC clients read the status from the headers of an empty
+// HTTP 200 response instead of the body of an HTTP error
+func writeGRPCError(w http.ResponseWriter, status int, message string) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(grpcStatusFromHTTP(status)))
+	//grpc-message is percent encoded
+	h.Set("Grpc-Message", url.PathEscape(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpc.health.v1.HealthCheckRequest{service} in a gRPC frame
+func grpcHealthRequest(service string) []byte {
+	message := make([]byte, 0, len(service)+binary.MaxVarintLen64+1)
+	if service != "" {
+		message = append(message, 0x0a) //field 1, length delimited
+		message = binary.AppendUvarint(message, uint64(len(service)))
+		message = append(message, service...)
+	}
+
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+// reads the status field of a grpc.health.v1.HealthCheckResponse frame
+func grpcHealthStatus(frame []byte) (uint64, error) {
+	if len(frame) < 5 {
+		return 0, errors.New("short gRPC frame")
+	}
+	if frame[0] != 0 {
+		return 0, errors.New("compressed gRPC health response")
+	}
+
+	message := frame[5:]
+	if int(binary.BigEndian.Uint32(frame[1:5])) != len(message) {
+		return 0, errors.New("truncated gRPC health response")
+	}
+
+	var status uint64
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return 0, errors.New("malformed gRPC health response")
+		}
+		message = message[n:]
+
+		switch wireType := key & 7; wireType {
+		case 0:
+			value, n := binary.Uvarint(message)
+			if n <= 0 {
+				return 0, errors.New("malformed gRPC health response")
+			}
+			message = message[n:]
+			if key>>3 == 1 {
+				status = value
+			}
+		case 1, 5:
+			size := 8
+			if wireType == 5 {
+				size = 4
+			}
+			if len(message) < size {
+				return 0, errors.New("malformed gRPC health response")
+			}
+			message = message[size:]
+		case 2:
+			length, n := binary.Uvarint(message)
+			if n <= 0 || uint64(len(message)-n) < length {
+				return 0, errors.New("malformed gRPC health response")
+			}
+			message = message[n+int(length):]
+		default:
+			return 0, fmt.Errorf("unsupported wire type %d in gRPC health response", wireType)
+		}
+	}
+	return status, nil
+}
+
+// grpc.health.v1.Health/Check through the endpoint transport, nil when the endpoint is SERVING
+func (endpoint *Endpoint) grpcHealthCheck(check *HealthCheck) error {
+	if endpoint.ReverseProxy == nil {
+		return errors.New("endpoint not started")
+	}
+
+	target, err := url.Parse(endpoint.Address)
+	if err != nil {
+		return err
+	}
+	target.Path = grpcHealthCheckPath
+	target.RawQuery = ""
+
+	ctx, cancel := context.WithTimeout(context.Background(), check.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.String(), bytes.NewReader(grpcHealthRequest(check.Service)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	resp, err := endpoint.ReverseProxy.Transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("gRPC health check answered %s", resp.Status)
+	}
+
+	frame, err := io.ReadAll(io.LimitReader(resp.Body, maxGRPCHealthResponseSize))
+	if err != nil {
+		return err
+	}
+
+	//trailers-only responses carry the status in the headers
+	status := resp.Header.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Trailer.Get("Grpc-Status")
+	}
+	if status != "0" {
+		message, _ := url.PathUnescape(resp.Header.Get("Grpc-Message") + resp.Trailer.Get("Grpc-Message"))
+		return fmt.Errorf("gRPC health check failed with status %s: %s", status, message)
+	}
+
+	serving, err := grpcHealthStatus(frame)
+	if err != nil {
+		return err
+	}
+	if serving != grpcServing {
+		return fmt.Errorf("gRPC health check status %d, not serving", serving)
+	}
+	return nil
+}
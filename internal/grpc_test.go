@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestGRPCHealthRequest(t *testing.T) {
+	if got := grpcHealthRequest(""); !bytes.Equal(got, []byte{0, 0, 0, 0, 0}) {
+		t.Errorf("whole server request = %x", got)
+	}
+	want := []byte{0, 0, 0, 0, 5, 0x0a, 3, 'a', 'p', 'i'}
+	if got := grpcHealthRequest("api"); !bytes.Equal(got, want) {
+		t.Errorf("service request = %x, want %x", got, want)
+	}
+}
+
+func TestGRPCHealthStatus(t *testing.T) {
+	frame := func(message ...byte) []byte {
+		return append([]byte{0, 0, 0, 0, byte(len(message))}, message...)
+	}
+
+	tests := []struct {
+		name   string
+		frame  []byte
+		status uint64
+	}{
+		{"serving", frame(0x08, 1), grpcServing},
+		{"not serving", frame(0x08, 2), 2},
+		{"default unknown", frame(), 0},
+		//fields added by newer versions are skipped
+		{"unknown fields", frame(0x12, 2, 'x', 'y', 0x19, 1, 2, 3, 4, 5, 6, 7, 8, 0x25, 1, 2, 3, 4, 0x08, 1), grpcServing},
+	}
+	for _, test := range tests {
+		status, err := grpcHealthStatus(test.frame)
+		if err != nil || status != test.status {
+			t.Errorf("%s: status %d, %v, want %d", test.name, status, err, test.status)
+		}
+	}
+
+	for name, invalid := range map[string][]byte{
+		"short frame":      {0, 0, 0},
+		"compressed":       {1, 0, 0, 0, 2, 0x08, 1},
+		"truncated":        {0, 0, 0, 0, 3, 0x08, 1},
+		"truncated varint": frame(0x08, 0x80),
+		"long field":       frame(0x12, 5, 'x'),
+		"group wire type":  frame(0x0b),
+	} {
+		if _, err := grpcHealthStatus(invalid); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestWriteGRPCError(t *testing.T) {
+	tests := map[int]string{
+		http.StatusNotFound:           "12",
+		http.StatusServiceUnavailable: "14",
+		http.StatusGatewayTimeout:     "14",
+		http.StatusUnauthorized:       "16",
+		http.StatusTeapot:             "2",
+	}
+	for status, want := range tests {
+		w := httptest.NewRecorder()
+		w.Header().Set("Content-Length", "10")
+		writeGRPCError(w, status, "no endpoint available")
+
+		if w.Code != http.StatusOK || w.Header().Get("Grpc-Status") != want {
+			t.Errorf("HTTP %d: code %d, grpc-status %q, want %s", status, w.Code, w.Header().Get("Grpc-Status"), want)
+		}
+		if got := w.Header().Get("Grpc-Message"); got != "no%20endpoint%20available" {
+			t.Errorf("HTTP %d: grpc-message %q", status, got)
+		}
+		if w.Header().Get("Content-Length") != "" {
+			t.Errorf("HTTP %d: content length kept", status)
+		}
+	}
+}
+
+func TestGRPCHealthCheckAtStart(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != grpcHealthCheckPath {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		//NOT_SERVING while the port accepts connections, a tcp check would find it up
+		w.Write([]byte{0, 0, 0, 0, 2, 0x08, 2})
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer backend.Close()
+
+	conf := startTestConf(t, testBindConf("", `"grpc": true, "healthCheck": {"type": "grpc"},`, backend.URL))
+
+	//checked through gRPC as soon as the endpoint is started, not at the next interval
+	if endpoint := conf.Settings.Bind[0].Groups[0].Endpoints[0]; endpoint.Alive.Load() {
+		t.Error("endpoint not serving gRPC up after the start")
+	}
+}
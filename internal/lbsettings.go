@@ -1,14 +1,18 @@
 package internal
 
 import (
+	"context"
+	"errors"
 	"log/slog"
 	"time"
 )
 
+const DefaultHealthCheckInterval time.Duration = 15 * time.Second
+
 type LoadBalancerSettings struct {
 	Bind                []*Bind                     `json:"bindings"`
 	HealthCheckInterval string                      `json:"healthCheckInterval,omitempty"`
-	healthCheckTicker   *time.Ticker                `json:"-"`
+	healthCheckStop     chan struct{}               `json:"-"`
 	PersistentSession   StatelessSessionPersistence `json:"sessionPersistenceDetails"`
 }
 
@@ -29,27 +33,18 @@ type LoadBalancerSettings struct {
 // 	})
 // }
 
-func (s *LoadBalancerSettings) passiveHealthCheck() {
-
-	var duration time.Duration
-
-	if s.HealthCheckInterval == "" {
-		duration, _ = time.ParseDuration("15s")
-	} else {
-		d, e := time.ParseDuration(s.HealthCheckInterval)
-		if e != nil {
-			duration, _ = time.ParseDuration("15s")
-		} else {
-			duration = d
+func (s *LoadBalancerSettings) passiveHealthCheck(ticker *time.Ticker, stop chan struct{}) {
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			slog.Debug("Passive health check started")
+			s.HealthCheck()
+			slog.Debug("Passive health check completed")
 		}
 	}
-
-	s.healthCheckTicker = time.NewTicker(duration)
-	for range s.healthCheckTicker.C {
-		slog.Debug("Passive health check started")
-		s.HealthCheck()
-		slog.Debug("Passive health check completed")
-	}
 }
 
 func (s *LoadBalancerSettings) HealthCheck() {
@@ -58,36 +53,64 @@ func (s *LoadBalancerSettings) HealthCheck() {
 			for _, endpoint := range group.Endpoints {
 				endpoint.HealthCheck()
 			}
+			if group.Mirror != nil {
+				for _, endpoint := range group.Mirror.Endpoints {
+					endpoint.HealthCheck()
+				}
+			}
+		}
+	}
+}
+
+func (s *LoadBalancerSettings) usesPersistentSession() bool {
+	for _, listener := range s.Bind {
+		for _, group := range listener.Groups {
+			if group.usesSessionCookie() {
+				return true
+			}
 		}
 	}
+	return false
 }
 
 func (s *LoadBalancerSettings) startPassiveHealthCheck() {
 	s.HealthCheck()
-	go s.passiveHealthCheck()
+	s.healthCheckStop = make(chan struct{})
+	go s.passiveHealthCheck(time.NewTicker(getWithDefaultDuration(s.HealthCheckInterval, DefaultHealthCheckInterval)), s.healthCheckStop)
 }
 
-func (s *LoadBalancerSettings) Start() error {
+func (s *LoadBalancerSettings) Start(conf *Conf) error {
+	if err := s.PersistentSession.Start(s.usesPersistentSession()); err != nil {
+		return err
+	}
+
 	s.startPassiveHealthCheck()
 
 	for _, listener := range s.Bind {
-		err := listener.Start()
+		err := listener.Start(conf)
 		if err != nil {
 			slog.Error("error during listener start", "error", err)
+			return err
 		}
 	}
 
 	return nil
 }
 
-func (s *LoadBalancerSettings) Stop() {
-
+func (s *LoadBalancerSettings) Stop(ctx context.Context) error {
+	var errs []error
 	for _, listener := range s.Bind {
-		err := listener.Stop()
+		err := listener.Stop(ctx)
 		if err != nil {
 			slog.Error("error stopping listener", "error", err)
+			errs = append(errs, err)
 		}
 	}
 
-	s.healthCheckTicker.Stop()
+	if s.healthCheckStop != nil {
+		close(s.healthCheckStop)
+		s.healthCheckStop = nil
+	}
+
+	return errors.Join(errs...)
 }
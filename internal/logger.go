@@ -3,18 +3,32 @@ package internal
 import (
 	"log"
 	"log/slog"
+	"sync"
 )
 
 type Logger struct {
 	EnableDebug   bool        `json:"enableDebug"`
 	ch            chan []byte `json:"-"`
 	DefaultLogger log.Logger  `json:"-"`
+
+	//slog default replaced by Start, restored by Stop
+	previousSlog *slog.Logger  `json:"-"`
+	done         chan struct{} `json:"-"`
+	//held for reading while sending on ch, so that Stop never closes it under a writer
+	mu      sync.RWMutex `json:"-"`
+	stopped bool         `json:"-"`
 }
 
 func (logger *Logger) Start() error {
 
-	//copying original logger
+	//copying original loggers
 	logger.DefaultLogger = *log.Default()
+	logger.previousSlog = slog.Default()
+
+	//init channel for async logging before any write can reach it
+	logger.ch = make(chan []byte)
+	logger.done = make(chan struct{})
+	go logger.logRecv()
 
 	var slogHandler *slog.HandlerOptions = nil
 	if logger.EnableDebug {
@@ -25,19 +39,33 @@ func (logger *Logger) Start() error {
 	//setting default this as default logger for log
 	log.SetOutput(logger)
 
-	//init channel for async logging
-	logger.ch = make(chan []byte)
-	go logger.logRecv()
-
 	return nil
 }
 
+// restores the previous slog and log outputs, messages still written to the logger
+// afterwards (e.g. by goroutines holding the slog handler) go to the original output
 func (logger *Logger) Stop() {
-	log.SetOutput(logger.DefaultLogger.Writer())
+	logger.mu.Lock()
+	if logger.ch == nil || logger.stopped {
+		logger.mu.Unlock()
+		return
+	}
+	logger.stopped = true
 	close(logger.ch)
+	logger.mu.Unlock()
+
+	//slog.SetDefault redirects log to the handler and clears its flags, log is restored after it
+	slog.SetDefault(logger.previousSlog)
+	log.SetOutput(logger.DefaultLogger.Writer())
+	log.SetFlags(logger.DefaultLogger.Flags())
+	log.SetPrefix(logger.DefaultLogger.Prefix())
+
+	//every queued message is printed before returning
+	<-logger.done
 }
 
 func (logger *Logger) logRecv() {
+	defer close(logger.done)
 	for message := range logger.ch {
 		msgstring := string(message)
 		logger.DefaultLogger.Print(msgstring)
@@ -47,9 +75,18 @@ func (logger *Logger) logRecv() {
 func (logger *Logger) Write(p []byte) (n int, err error) {
 	l := len(p)
 
-	catchUnwind(func() {
-		logger.ch <- p
-	})
+	//the caller is free to reuse p once Write returns, the message is consumed asynchronously
+	message := make([]byte, l)
+	copy(message, p)
+
+	logger.mu.RLock()
+	defer logger.mu.RUnlock()
+
+	if logger.stopped || logger.ch == nil {
+		logger.DefaultLogger.Print(string(message))
+		return l, nil
+	}
+	logger.ch <- message
 
 	return l, nil
 }
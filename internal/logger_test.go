@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// buffer safe for the concurrent writes of the logger
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func captureLog(t *testing.T) *syncBuffer {
+	t.Helper()
+	output, flags, defaultSlog := log.Writer(), log.Flags(), slog.Default()
+	t.Cleanup(func() {
+		slog.SetDefault(defaultSlog)
+		log.SetOutput(output)
+		log.SetFlags(flags)
+	})
+
+	buffer := &syncBuffer{}
+	log.SetOutput(buffer)
+	log.SetFlags(0)
+	return buffer
+}
+
+func TestLoggerStopRestoresDefaults(t *testing.T) {
+	buffer := captureLog(t)
+	defaultSlog := slog.Default()
+
+	logger := &Logger{}
+	if err := logger.Start(); err != nil {
+		t.Fatal(err)
+	}
+	slog.Info("through the logger")
+	log.Print("log through the logger")
+	logger.Stop()
+
+	if slog.Default() != defaultSlog {
+		t.Error("Stop did not restore the slog default")
+	}
+	if log.Writer() != buffer || log.Flags() != 0 {
+		t.Error("Stop did not restore the log output and flags")
+	}
+	for _, want := range []string{"msg=\"through the logger\"", "log through the logger"} {
+		if !strings.Contains(buffer.String(), want) {
+			t.Errorf("%q was not flushed by Stop, got %q", want, buffer.String())
+		}
+	}
+}
+
+func TestLoggerWriteAfterStop(t *testing.T) {
+	buffer := captureLog(t)
+
+	logger := &Logger{}
+	if err := logger.Start(); err != nil {
+		t.Fatal(err)
+	}
+	//a handler kept by someone else keeps writing through the stopped logger
+	handler := slog.Default()
+	logger.Stop()
+	logger.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.Info("after stop")
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("writing after Stop blocked")
+	}
+	if !strings.Contains(buffer.String(), "after stop") {
+		t.Errorf("message written after Stop lost, got %q", buffer.String())
+	}
+}
+
+func TestLoggerConcurrentStop(t *testing.T) {
+	captureLog(t)
+
+	logger := &Logger{}
+	if err := logger.Start(); err != nil {
+		t.Fatal(err)
+	}
+	handler := slog.Default()
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				handler.Info("concurrent", "writer", i)
+			}
+		}()
+	}
+	logger.Stop()
+	wg.Wait()
+}
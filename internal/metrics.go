@@ -0,0 +1,275 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const DefaultMetricsPath = "/metrics"
+
+// exposes the metrics in the Prometheus text format
+type Metrics struct {
+	Address string `json:"address"`
+	Path    string `json:"path,omitempty"`
+
+	server *http.Server `json:"-"`
+}
+
+func (m *Metrics) Start(registry *metricsRegistry) error {
+	ln, err := net.Listen("tcp", m.Address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	path := m.Path
+	if path == "" {
+		path = DefaultMetricsPath
+	}
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		registry.write(w)
+	})
+
+	m.server = &http.Server{Handler: mux, ReadHeaderTimeout: DefaultReadHeaderTimeout}
+	go func() {
+		if err := m.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("metrics server failed", "error", err)
+		}
+	}()
+	return nil
+}
+
+// scrapes are short, there is nothing worth waiting for
+func (m *Metrics) Stop() error {
+	if m.server == nil {
+		return nil
+	}
+	return m.server.Close()
+}
+
+type metricsRegistry struct {
+	mu       sync.Mutex
+	families []*metricFamily
+}
+
+// families reported by a balancer instance, every Conf owns its registry so that
+// instances embedded in the same process never share series
+type balancerMetrics struct {
+	registry *metricsRegistry
+
+	rawConnections        *metricFamily
+	rawConnectionsTotal   *metricFamily
+	rawConnectErrorsTotal *metricFamily
+
+	udpFlows                 *metricFamily
+	udpFlowsTotal            *metricFamily
+	udpDatagramsDroppedTotal *metricFamily
+
+	upgradedConnections        *metricFamily
+	upgradedConnectionsTotal   *metricFamily
+	upgradesRejectedTotal      *metricFamily
+	upgradedConnectionDuration *metricFamily
+
+	mirroredRequestsTotal    *metricFamily
+	mirroredRequestsInFlight *metricFamily
+	mirroredRequestDuration  *metricFamily
+}
+
+func newBalancerMetrics() *balancerMetrics {
+	registry := &metricsRegistry{}
+	return &balancerMetrics{
+		registry: registry,
+
+		rawConnections: registry.gauge("minibalancer_raw_connections",
+			"Raw connections currently proxied.", "bind", "endpoint"),
+		rawConnectionsTotal: registry.counter("minibalancer_raw_connections_total",
+			"Raw connections proxied.", "bind", "endpoint"),
+		rawConnectErrorsTotal: registry.counter("minibalancer_raw_connect_errors_total",
+			"Failed connections to endpoints of raw binds.", "bind", "endpoint"),
+
+		udpFlows: registry.gauge("minibalancer_udp_flows",
+			"UDP flows currently tracked.", "bind", "endpoint"),
+		udpFlowsTotal: registry.counter("minibalancer_udp_flows_total",
+			"UDP flows created.", "bind", "endpoint"),
+		udpDatagramsDroppedTotal: registry.counter("minibalancer_udp_datagrams_dropped_total",
+			"Client datagrams dropped because no endpoint could take them (no_endpoint), the bind tracks maxFlows flows (max_flows) or no socket could be opened for a new flow (dial_error).", "bind", "reason"),
+
+		upgradedConnections: registry.gauge("minibalancer_upgraded_connections",
+			"Upgraded connections currently open.", "group", "endpoint"),
+		upgradedConnectionsTotal: registry.counter("minibalancer_upgraded_connections_total",
+			"Upgraded connections established.", "group", "endpoint"),
+		upgradesRejectedTotal: registry.counter("minibalancer_upgrades_rejected_total",
+			"Upgrade requests rejected because the group reached maxConnections.", "group"),
+		upgradedConnectionDuration: registry.histogram("minibalancer_upgraded_connection_duration_seconds",
+			"Lifetime of upgraded connections.", []float64{1, 10, 60, 300, 900, 1800, 3600, 14400}, "group"),
+
+		mirroredRequestsTotal: registry.counter("minibalancer_mirrored_requests_total",
+			"Mirrored requests by result: ok (response discarded), error, dropped (maxInFlight reached) or skipped (body too big, unknown length or unread by the primary, Expect: 100-continue).", "group", "result"),
+		mirroredRequestsInFlight: registry.gauge("minibalancer_mirrored_requests_in_flight",
+			"Mirrored requests waiting for the mirror response.", "group"),
+		mirroredRequestDuration: registry.histogram("minibalancer_mirrored_request_duration_seconds",
+			"Time to the mirror response headers.", []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "group"),
+	}
+}
+
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	//upper bounds, histograms only
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	//counters and gauges
+	value atomic.Int64
+	//histograms, the sum is stored as float64 bits
+	buckets []float64
+	counts  []atomic.Uint64
+	count   atomic.Uint64
+	sum     atomic.Uint64
+}
+
+func (registry *metricsRegistry) register(family *metricFamily) *metricFamily {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	family.series = make(map[string]*metricSeries)
+	registry.families = append(registry.families, family)
+	return family
+}
+
+func (registry *metricsRegistry) counter(name string, help string, labels ...string) *metricFamily {
+	return registry.register(&metricFamily{name: name, help: help, kind: "counter", labels: labels})
+}
+
+func (registry *metricsRegistry) gauge(name string, help string, labels ...string) *metricFamily {
+	return registry.register(&metricFamily{name: name, help: help, kind: "gauge", labels: labels})
+}
+
+func (registry *metricsRegistry) histogram(name string, help string, buckets []float64, labels ...string) *metricFamily {
+	return registry.register(&metricFamily{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets})
+}
+
+// series of the given label values, created on first use
+func (family *metricFamily) with(labelValues ...string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+
+	family.mu.Lock()
+	defer family.mu.Unlock()
+
+	series, ok := family.series[key]
+	if !ok {
+		series = &metricSeries{labelValues: labelValues}
+		if family.kind == "histogram" {
+			series.buckets = family.buckets
+			series.counts = make([]atomic.Uint64, len(family.buckets))
+		}
+		family.series[key] = series
+	}
+	return series
+}
+
+func (series *metricSeries) add(delta int64) {
+	series.value.Add(delta)
+}
+
+func (series *metricSeries) inc() {
+	series.value.Add(1)
+}
+
+func (series *metricSeries) dec() {
+	series.value.Add(-1)
+}
+
+func (series *metricSeries) observe(value float64) {
+	for i, bound := range series.buckets {
+		if value <= bound {
+			series.counts[i].Add(1)
+		}
+	}
+	series.count.Add(1)
+
+	for {
+		old := series.sum.Load()
+		if series.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+value)) {
+			return
+		}
+	}
+}
+
+// label values escaping of the text format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, extra[0]+`="`+labelEscaper.Replace(extra[1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (registry *metricsRegistry) write(w io.Writer) {
+	registry.mu.Lock()
+	families := append([]*metricFamily(nil), registry.families...)
+	registry.mu.Unlock()
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+	for _, family := range families {
+		family.write(w)
+	}
+}
+
+func (family *metricFamily) write(w io.Writer) {
+	family.mu.Lock()
+	keys := make([]string, 0, len(family.series))
+	for key := range family.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	series := make([]*metricSeries, len(keys))
+	for i, key := range keys {
+		series[i] = family.series[key]
+	}
+	family.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+	for _, s := range series {
+		if family.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %d\n", family.name, formatLabels(family.labels, s.labelValues), s.value.Load())
+			continue
+		}
+
+		for i, bound := range family.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", family.name, formatLabels(family.labels, s.labelValues, "le", formatFloat(bound)), s.counts[i].Load())
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", family.name, formatLabels(family.labels, s.labelValues, "le", "+Inf"), s.count.Load())
+		fmt.Fprintf(w, "%s_sum%s %s\n", family.name, formatLabels(family.labels, s.labelValues), formatFloat(math.Float64frombits(s.sum.Load())))
+		fmt.Fprintf(w, "%s_count%s %d\n", family.name, formatLabels(family.labels, s.labelValues), s.count.Load())
+	}
+}
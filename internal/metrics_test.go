@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricsTextFormat(t *testing.T) {
+	registry := &metricsRegistry{}
+	counter := registry.counter("test_total", "Test counter.", "group")
+	histogram := registry.histogram("test_seconds", "Test histogram.", []float64{1, 10}, "group")
+
+	counter.with(`a"b`).add(2)
+	counter.with(`a"b`).inc()
+	histogram.with("g").observe(0.5)
+	histogram.with("g").observe(5)
+
+	var out bytes.Buffer
+	registry.write(&out)
+
+	want := `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{group="g",le="1"} 1
+test_seconds_bucket{group="g",le="10"} 2
+test_seconds_bucket{group="g",le="+Inf"} 2
+test_seconds_sum{group="g"} 5.5
+test_seconds_count{group="g"} 2
+# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{group="a\"b"} 3
+`
+	if out.String() != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+func TestMetricsPerInstance(t *testing.T) {
+	first := newBalancerMetrics()
+	second := newBalancerMetrics()
+
+	first.rawConnectionsTotal.with(":5432", "db:5432").inc()
+
+	var out bytes.Buffer
+	second.registry.write(&out)
+	if strings.Contains(out.String(), "db:5432") {
+		t.Error("series of an instance reported by another one")
+	}
+
+	out.Reset()
+	first.registry.write(&out)
+	if strings.Count(out.String(), "# TYPE minibalancer_raw_connections_total ") != 1 {
+		t.Errorf("family registered more than once:\n%s", out.String())
+	}
+}
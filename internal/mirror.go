@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMirrorMaxBodySize int64         = 1 << 20
+	DefaultMirrorTimeout     time.Duration = 5 * time.Second
+	DefaultMirrorMaxInFlight int           = 100
+
+	//read from the mirror response before closing it, enough to reuse most connections
+	maxMirrorResponseDrain = 64 << 10
+)
+
+// shadow traffic: a copy of the requests of the group is sent to other endpoints, their
+// responses are discarded. The body is copied while the primary endpoint reads it and
+// the copy is sent in the background, so a slow mirror never delays the primary response.
+// Requests expecting 100-continue are not mirrored
+type Mirror struct {
+	Endpoints []*Endpoint `json:"endpoints"`
+	Algorithm string      `json:"algorithm,omitempty"`
+	//share of the requests mirrored, from 0 (excluded) to 100 (default)
+	Percentage float64 `json:"percentage,omitempty"`
+	//requests with a bigger body, or with a body of unknown length (chunked uploads,
+	//gRPC streams), are not mirrored: the copy of the body is kept in memory
+	MaxBodySize int64  `json:"maxBodySize,omitempty"`
+	Timeout     string `json:"timeout,omitempty"`
+	//mirrored requests in flight at the same time, the ones over the limit are dropped
+	MaxInFlight int `json:"maxInFlight,omitempty"`
+
+	group    *Group           `json:"-"`
+	timeout  time.Duration    `json:"-"`
+	inFlight chan struct{}    `json:"-"`
+	name     string           `json:"-"`
+	metrics  *balancerMetrics `json:"-"`
+}
+
+// headers of the client connection, see httputil.ReverseProxy
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// the mirror endpoints are a group of their own, balanced and health checked like the
+// primary ones
+func (m *Mirror) Start(parent *Group, conf *Conf) error {
+	if m.Percentage < 0 || m.Percentage > 100 {
+		return fmt.Errorf("mirror percentage %v out of range", m.Percentage)
+	}
+	if m.Percentage == 0 {
+		m.Percentage = 100
+	}
+	if len(m.Endpoints) == 0 {
+		return errors.New("mirror without endpoints")
+	}
+
+	m.group = &Group{Address: parent.Address, Path: parent.Path, Endpoints: m.Endpoints, Algorithm: m.Algorithm}
+	if err := m.group.Start(conf); err != nil {
+		return fmt.Errorf("error initializing mirror: %w", err)
+	}
+
+	if m.MaxBodySize == 0 {
+		m.MaxBodySize = DefaultMirrorMaxBodySize
+	}
+	m.timeout = getWithDefaultDuration(m.Timeout, DefaultMirrorTimeout)
+	m.inFlight = make(chan struct{}, getWithDefaultInt(m.MaxInFlight, DefaultMirrorMaxInFlight))
+	m.name = parent.metricsName()
+	m.metrics = conf.metrics
+	return nil
+}
+
+func (m *Mirror) Stop() {
+	m.group.Stop()
+}
+
+// samples the request and copies its body while the primary endpoint reads it, the copy
+// is sent in the background once the body is complete. The returned function is called
+// when the primary request is served, a body the primary did not read is not mirrored
+func (m *Mirror) mirror(r *http.Request) func() {
+	if m.Percentage < 100 && rand.Float64()*100 >= m.Percentage {
+		return func() {}
+	}
+	if isUpgradeRequest(r) {
+		return func() {}
+	}
+	//the body is copied in memory, and the mirror must not read the body of a request
+	//expecting 100-continue before the primary endpoint answers it
+	if strings.EqualFold(r.Header.Get("Expect"), "100-continue") || r.ContentLength < 0 || r.ContentLength > m.MaxBodySize {
+		m.metrics.mirroredRequestsTotal.with(m.name, "skipped").inc()
+		return func() {}
+	}
+
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		m.metrics.mirroredRequestsTotal.with(m.name, "dropped").inc()
+		return func() {}
+	}
+
+	//the copy is made now, the primary request is modified while it is served
+	req := m.request(r)
+	if r.ContentLength == 0 {
+		go m.send(req, nil)
+		return func() {}
+	}
+
+	body := &mirrorBody{ReadCloser: r.Body, mirror: m, req: req, buf: make([]byte, 0, r.ContentLength)}
+	r.Body = body
+	return body.finish
+}
+
+// tees the primary request body, the reads stay with the primary
+type mirrorBody struct {
+	io.ReadCloser
+	mirror *Mirror
+	req    *http.Request
+
+	//the transport can still read the body after the primary response
+	mu       sync.Mutex
+	buf      []byte
+	overflow bool
+	finished bool
+}
+
+func (body *mirrorBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+
+	body.mu.Lock()
+	complete := false
+	if !body.finished && !body.overflow {
+		if len(body.buf)+n > cap(body.buf) {
+			body.overflow = true
+		} else {
+			body.buf = append(body.buf, p[:n]...)
+			complete = len(body.buf) == cap(body.buf)
+		}
+	}
+	body.mu.Unlock()
+
+	if complete {
+		body.finish()
+	}
+	return n, err
+}
+
+// sends the copy when the whole body was read, called at the end of the body and when
+// the primary request is served
+func (body *mirrorBody) finish() {
+	body.mu.Lock()
+	if body.finished {
+		body.mu.Unlock()
+		return
+	}
+	body.finished = true
+	complete := !body.overflow && len(body.buf) == cap(body.buf)
+	body.mu.Unlock()
+
+	m := body.mirror
+	if !complete {
+		<-m.inFlight
+		m.metrics.mirroredRequestsTotal.with(m.name, "skipped").inc()
+		return
+	}
+	go m.send(body.req, body.buf)
+}
+
+// copy of the request without its body, detached from the client connection
+func (m *Mirror) request(r *http.Request) *http.Request {
+	req := r.Clone(context.Background())
+	req.RequestURI = ""
+	req.Close = false
+	req.ContentLength = 0
+	req.Body = http.NoBody
+
+	for _, header := range hopHeaders {
+		req.Header.Del(header)
+	}
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := req.Header.Values("X-Forwarded-For"); len(prior) != 0 {
+			clientIP = fmt.Sprintf("%s, %s", prior[len(prior)-1], clientIP)
+		}
+		req.Header.Set("X-Forwarded-For", clientIP)
+	}
+	return req
+}
+
+// releases the in flight slot taken by mirror once done
+func (m *Mirror) send(req *http.Request, body []byte) {
+	defer func() { <-m.inFlight }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+	if len(body) != 0 {
+		req.ContentLength = int64(len(body))
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	endpoint, err := m.group.getBalancedEndpoint(req, m.group.Endpoints)
+	if err == nil && endpoint.ReverseProxy == nil {
+		err = errors.New("endpoint not started")
+	}
+	if err != nil {
+		slog.Debug("no mirror endpoint", "group", m.name, "error", err)
+		m.metrics.mirroredRequestsTotal.with(m.name, "error").inc()
+		return
+	}
+
+	endpoint.ActiveConnections.Add(1)
+	defer endpoint.ActiveConnections.Add(^uint64(0))
+	inFlight := m.metrics.mirroredRequestsInFlight.with(m.name)
+	inFlight.inc()
+	defer inFlight.dec()
+
+	//same rewrite as the proxied requests, including proxyPass
+	endpoint.ReverseProxy.Director(req)
+
+	start := time.Now()
+	resp, err := endpoint.ReverseProxy.Transport.RoundTrip(req)
+	if err != nil {
+		slog.Debug("mirror request failed", "endpoint", endpoint.Address, "error", err)
+		m.metrics.mirroredRequestsTotal.with(m.name, "error").inc()
+		return
+	}
+	m.metrics.mirroredRequestDuration.with(m.name).observe(time.Since(start).Seconds())
+	m.metrics.mirroredRequestsTotal.with(m.name, "ok").inc()
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxMirrorResponseDrain))
+	resp.Body.Close()
+}
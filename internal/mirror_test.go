@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mirror endpoint recording the bodies received, handlers wait for release when stalled
+type mirrorRecorder struct {
+	mu      sync.Mutex
+	bodies  []string
+	release chan struct{}
+}
+
+func newMirrorRecorder(t *testing.T, stalled bool) (*mirrorRecorder, string) {
+	t.Helper()
+	recorder := &mirrorRecorder{release: make(chan struct{})}
+	if !stalled {
+		close(recorder.release)
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		recorder.mu.Lock()
+		recorder.bodies = append(recorder.bodies, string(body))
+		recorder.mu.Unlock()
+		<-recorder.release
+	}))
+	t.Cleanup(backend.Close)
+	//handlers must return before the server closes
+	if stalled {
+		t.Cleanup(func() { close(recorder.release) })
+	}
+	return recorder, backend.URL
+}
+
+func (recorder *mirrorRecorder) received() []string {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	return append([]string(nil), recorder.bodies...)
+}
+
+// bind proxying to a primary endpoint answering with the body it received, mirror is the
+// JSON of the mirror settings without the endpoints
+func startMirrorConf(t *testing.T, mirror string, mirrorURL string) (*Conf, string) {
+	t.Helper()
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	t.Cleanup(primary.Close)
+
+	group := fmt.Sprintf(`"mirror": {%s "endpoints": [{"address": %q}]},`, mirror, mirrorURL)
+	conf := startTestConf(t, testBindConf("", group, primary.URL))
+	return conf, "http://" + conf.Settings.Bind[0].listenAddr() + "/"
+}
+
+func post(t *testing.T, url string, body string) string {
+	t.Helper()
+	resp, err := http.Post(url, "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	answer, _ := io.ReadAll(resp.Body)
+	return string(answer)
+}
+
+func mirrorMetric(conf *Conf, result string) string {
+	var out bytes.Buffer
+	conf.metrics.registry.write(&out)
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, "minibalancer_mirrored_requests_total{") && strings.Contains(line, fmt.Sprintf("result=%q", result)) {
+			return line[strings.LastIndexByte(line, ' ')+1:]
+		}
+	}
+	return "0"
+}
+
+func TestMirrorBody(t *testing.T) {
+	recorder, mirrorURL := newMirrorRecorder(t, false)
+	conf, url := startMirrorConf(t, `"maxBodySize": 8,`, mirrorURL)
+
+	if answer := post(t, url, "mirrored"); answer != "mirrored" {
+		t.Errorf("primary received %q", answer)
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return len(recorder.received()) == 1 }) {
+		t.Fatal("request not mirrored")
+	}
+	if body := recorder.received()[0]; body != "mirrored" {
+		t.Errorf("mirror received %q", body)
+	}
+
+	//too big for the mirror, untouched for the primary
+	if answer := post(t, url, "not mirrored"); answer != "not mirrored" {
+		t.Errorf("primary received %q", answer)
+	}
+	if !waitFor(t, time.Second, func() bool { return mirrorMetric(conf, "skipped") == "1" }) {
+		t.Errorf("body over maxBodySize not skipped, skipped = %s", mirrorMetric(conf, "skipped"))
+	}
+	if received := recorder.received(); len(received) != 1 {
+		t.Errorf("mirror received %q", received)
+	}
+}
+
+func TestMirrorPercentage(t *testing.T) {
+	recorder, mirrorURL := newMirrorRecorder(t, false)
+	_, url := startMirrorConf(t, `"percentage": 30,`, mirrorURL)
+
+	const requests = 400
+	for range requests {
+		post(t, url, "")
+	}
+	//about 120, far enough from the bounds for the test not to be flaky
+	time.Sleep(200 * time.Millisecond)
+	if mirrored := len(recorder.received()); mirrored < 80 || mirrored > 160 {
+		t.Errorf("%d requests out of %d mirrored at 30%%", mirrored, requests)
+	}
+}
+
+func TestMirrorStalled(t *testing.T) {
+	recorder, mirrorURL := newMirrorRecorder(t, true)
+	conf, url := startMirrorConf(t, `"maxInFlight": 1,`, mirrorURL)
+
+	//the primary answers while the mirror holds the only in flight slot
+	for _, body := range []string{"first", "second"} {
+		start := time.Now()
+		if answer := post(t, url, body); answer != body {
+			t.Errorf("primary received %q", answer)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("primary answered after %v", elapsed)
+		}
+	}
+
+	if mirrorMetric(conf, "dropped") != "1" {
+		t.Errorf("request over maxInFlight not dropped, dropped = %s", mirrorMetric(conf, "dropped"))
+	}
+	if !waitFor(t, time.Second, func() bool { return len(recorder.received()) == 1 }) || recorder.received()[0] != "first" {
+		t.Errorf("mirror received %q", recorder.received())
+	}
+}
+
+func TestMirrorSlowClientBody(t *testing.T) {
+	recorder, mirrorURL := newMirrorRecorder(t, false)
+	arrived := make(chan struct{})
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		io.Copy(w, r.Body)
+	}))
+	defer primary.Close()
+
+	group := fmt.Sprintf(`"mirror": {"endpoints": [{"address": %q}]},`, mirrorURL)
+	conf := startTestConf(t, testBindConf("", group, primary.URL))
+
+	conn, err := net.Dial("tcp", conf.Settings.Bind[0].listenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	//the primary gets the request before the client sends the whole body
+	fmt.Fprint(conn, "POST / HTTP/1.1\r\nHost: test\r\nContent-Length: 8\r\n\r\nslow")
+	select {
+	case <-arrived:
+	case <-time.After(time.Second):
+		t.Fatal("request held until the end of the body")
+	}
+	fmt.Fprint(conn, "body")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(answer) != "slowbody" {
+		t.Errorf("primary received %q", answer)
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return len(recorder.received()) == 1 }) || recorder.received()[0] != "slowbody" {
+		t.Errorf("mirror received %q", recorder.received())
+	}
+}
+
+func TestMirrorExpectContinue(t *testing.T) {
+	recorder, mirrorURL := newMirrorRecorder(t, false)
+	conf, url := startMirrorConf(t, "", mirrorURL)
+
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader("body"))
+	req.Header.Set("Expect", "100-continue")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(answer) != "body" {
+		t.Errorf("primary received %q", answer)
+	}
+
+	if mirrorMetric(conf, "skipped") != "1" {
+		t.Errorf("request expecting 100-continue not skipped, skipped = %s", mirrorMetric(conf, "skipped"))
+	}
+	if received := recorder.received(); len(received) != 0 {
+		t.Errorf("mirror received %q", received)
+	}
+}
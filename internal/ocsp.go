@@ -0,0 +1,326 @@
+package internal
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	DefaultOCSPCacheDir string        = "ocsp"
+	DefaultOCSPTimeout  time.Duration = 10 * time.Second
+	//used when the responder does not set nextUpdate
+	DefaultOCSPRefresh time.Duration = time.Hour
+	//wait before a new attempt when the responder cannot be reached
+	ocspRetryInterval   time.Duration = time.Minute
+	maxOCSPResponseSize               = 1 << 20
+)
+
+// responses are fetched for every certificate having a responder url and its issuer
+// in the chain, stapled to the handshakes and refreshed before they expire
+type OCSPStapling struct {
+	//stapling is opt-in, it queries the responder of every certificate of the bind
+	Enable bool `json:"enable"`
+	//overrides the responder url of the certificates, e.g. an internal responder
+	ResponderURL string `json:"responderUrl,omitempty"`
+	//responses cached on disk so a restart does not depend on the responder, relative to basePath
+	CacheDir string `json:"cacheDir,omitempty"`
+	Timeout  string `json:"timeout,omitempty"`
+}
+
+// client used to query the responders
+var ocspHTTPClient = &http.Client{}
+
+var errOCSPRevoked = errors.New("certificate revoked")
+
+type stapledCert struct {
+	index     int
+	leaf      *x509.Certificate
+	issuer    *x509.Certificate
+	responder string
+	//empty when the cache directory cannot be created
+	cacheFile string
+	//of the stapled response, zero when nothing is stapled or the response never expires.
+	//Used only by the watcher of the certificate once started
+	nextUpdate time.Time
+}
+
+// serves the bind certificates with their current staple, the certificate set
+// is swapped as a whole when a response is refreshed
+type ocspStapler struct {
+	certs   atomic.Pointer[[]tls.Certificate]
+	mu      sync.Mutex
+	timeout time.Duration
+	stop    chan struct{}
+}
+
+func newOCSPStapler(certs []tls.Certificate, settings *OCSPStapling, basePath string) (*ocspStapler, error) {
+	if settings == nil {
+		settings = &OCSPStapling{}
+	}
+
+	cacheDir := path.Join(basePath, DefaultOCSPCacheDir)
+	if settings.CacheDir != "" {
+		cacheDir = path.Join(basePath, settings.CacheDir)
+	}
+
+	stapler := &ocspStapler{
+		timeout: getWithDefaultDuration(settings.Timeout, DefaultOCSPTimeout),
+		stop:    make(chan struct{}),
+	}
+
+	loaded := make([]tls.Certificate, 0, len(certs))
+	var stapled []*stapledCert
+	for _, cert := range certs {
+		//certificates which failed to load are not served
+		if len(cert.Certificate) == 0 {
+			continue
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		cert.Leaf = leaf
+		loaded = append(loaded, cert)
+
+		responder := settings.ResponderURL
+		if responder == "" && len(leaf.OCSPServer) != 0 {
+			responder = leaf.OCSPServer[0]
+		}
+		if responder == "" {
+			continue
+		}
+
+		if len(cert.Certificate) < 2 {
+			slog.Warn("certificate chain without issuer, OCSP stapling disabled", "subject", leaf.Subject.String())
+			continue
+		}
+		issuer, err := x509.ParseCertificate(cert.Certificate[1])
+		if err != nil {
+			return nil, err
+		}
+
+		stapled = append(stapled, &stapledCert{
+			index:     len(loaded) - 1,
+			leaf:      leaf,
+			issuer:    issuer,
+			responder: responder,
+		})
+	}
+
+	if len(stapled) == 0 {
+		return nil, nil
+	}
+
+	//the cache only helps restarts, a read only configuration directory must not prevent the start
+	if err := os.MkdirAll(cacheDir, 0o700); err != nil {
+		slog.Warn("cannot create the OCSP cache directory, responses are kept in memory only", "dir", cacheDir, "error", err)
+	} else {
+		for _, sc := range stapled {
+			hash := sha256.Sum256(sc.leaf.Raw)
+			sc.cacheFile = path.Join(cacheDir, hex.EncodeToString(hash[:])+".ocsp")
+		}
+	}
+
+	stapler.certs.Store(&loaded)
+	for _, sc := range stapled {
+		//a valid cached response is stapled immediately, the responder is queried in background
+		refresh := time.Duration(0)
+		if raw, resp, err := sc.loadCache(); err == nil {
+			stapler.staple(sc, raw)
+			sc.nextUpdate = resp.NextUpdate
+			refresh = refreshDelay(resp)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("ignoring cached OCSP response", "file", sc.cacheFile, "reason", err)
+		}
+		go stapler.watch(sc, refresh)
+	}
+
+	return stapler, nil
+}
+
+// used as tls.Config.GetCertificate, mirrors the selection crypto/tls makes over Certificates
+func (stapler *ocspStapler) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs := *stapler.certs.Load()
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate configured")
+	}
+
+	for i := range certs {
+		if hello.SupportsCertificate(&certs[i]) == nil {
+			return &certs[i], nil
+		}
+	}
+	return &certs[0], nil
+}
+
+func (stapler *ocspStapler) staple(sc *stapledCert, raw []byte) {
+	stapler.mu.Lock()
+	defer stapler.mu.Unlock()
+
+	certs := append([]tls.Certificate(nil), *stapler.certs.Load()...)
+	certs[sc.index].OCSPStaple = raw
+	stapler.certs.Store(&certs)
+}
+
+func (stapler *ocspStapler) watch(sc *stapledCert, delay time.Duration) {
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-stapler.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		raw, resp, err := stapler.fetch(sc)
+		if errors.Is(err, errOCSPRevoked) {
+			slog.Error("certificate revoked, staple removed", "subject", sc.leaf.Subject.String(), "responder", sc.responder, "error", err)
+			stapler.revoke(sc)
+			delay = ocspRetryInterval
+			continue
+		}
+		if err != nil {
+			slog.Error("error fetching OCSP response", "subject", sc.leaf.Subject.String(), "responder", sc.responder, "error", err)
+			delay = stapler.expireStaple(sc)
+			continue
+		}
+
+		stapler.staple(sc, raw)
+		sc.nextUpdate = resp.NextUpdate
+		if sc.cacheFile != "" {
+			if err := os.WriteFile(sc.cacheFile, raw, 0o600); err != nil {
+				slog.Warn("error caching OCSP response", "file", sc.cacheFile, "error", err)
+			}
+		}
+
+		delay = refreshDelay(resp)
+		slog.Debug("OCSP response stapled", "subject", sc.leaf.Subject.String(), "nextUpdate", resp.NextUpdate, "refresh", delay)
+	}
+}
+
+// removes the staple once its nextUpdate has passed, a stale response would be refused
+// by clients. Returns the delay before the next attempt, never later than the expiry
+func (stapler *ocspStapler) expireStaple(sc *stapledCert) time.Duration {
+	if sc.nextUpdate.IsZero() {
+		return ocspRetryInterval
+	}
+
+	untilExpiry := time.Until(sc.nextUpdate)
+	if untilExpiry > 0 {
+		return min(ocspRetryInterval, untilExpiry)
+	}
+
+	slog.Warn("OCSP response expired, staple removed", "subject", sc.leaf.Subject.String(), "nextUpdate", sc.nextUpdate)
+	stapler.staple(sc, nil)
+	sc.nextUpdate = time.Time{}
+	return ocspRetryInterval
+}
+
+// a good response stapled or cached before the revocation must not be served anymore
+func (stapler *ocspStapler) revoke(sc *stapledCert) {
+	stapler.staple(sc, nil)
+	sc.nextUpdate = time.Time{}
+	if sc.cacheFile != "" {
+		if err := os.Remove(sc.cacheFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("error removing cached OCSP response", "file", sc.cacheFile, "error", err)
+		}
+	}
+}
+
+func (stapler *ocspStapler) fetch(sc *stapledCert) ([]byte, *ocsp.Response, error) {
+	request, err := ocsp.CreateRequest(sc.leaf, sc.issuer, &ocsp.RequestOptions{Hash: crypto.SHA1})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client := *ocspHTTPClient
+	client.Timeout = stapler.timeout
+	httpResp, err := client.Post(sc.responder, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("responder answered %s", httpResp.Status)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(httpResp.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := sc.parse(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return raw, resp, nil
+}
+
+// only good and unexpired responses are stapled
+func (sc *stapledCert) parse(raw []byte) (*ocsp.Response, error) {
+	resp, err := ocsp.ParseResponseForCert(raw, sc.leaf, sc.issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		return nil, fmt.Errorf("%w at %s", errOCSPRevoked, resp.RevokedAt)
+	default:
+		return nil, errors.New("certificate status unknown to the responder")
+	}
+
+	if !resp.NextUpdate.IsZero() && time.Now().After(resp.NextUpdate) {
+		return nil, errors.New("OCSP response expired")
+	}
+	return resp, nil
+}
+
+func (sc *stapledCert) loadCache() ([]byte, *ocsp.Response, error) {
+	if sc.cacheFile == "" {
+		return nil, nil, os.ErrNotExist
+	}
+	raw, err := os.ReadFile(sc.cacheFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := sc.parse(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return raw, resp, nil
+}
+
+// halfway through the validity window, so a failing responder leaves time to retry
+func refreshDelay(resp *ocsp.Response) time.Duration {
+	if resp.NextUpdate.IsZero() {
+		return DefaultOCSPRefresh
+	}
+
+	validity := resp.NextUpdate.Sub(resp.ThisUpdate)
+	return max(time.Until(resp.ThisUpdate.Add(validity/2)), 0)
+}
+
+func (stapler *ocspStapler) Stop() {
+	close(stapler.stop)
+}
@@ -0,0 +1,257 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// stand-in for an OCSP responder, answers good (or revoked) responses valid for
+// validity, or 500 while down
+type testResponder struct {
+	t      *testing.T
+	issuer *testCert
+
+	mu       sync.Mutex
+	validity time.Duration
+	down     bool
+	revoked  bool
+	requests int
+}
+
+func (responder *testResponder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	responder.mu.Lock()
+	defer responder.mu.Unlock()
+	responder.requests++
+
+	if responder.down {
+		http.Error(w, "down", http.StatusInternalServerError)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	request, err := ocsp.ParseRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().Truncate(time.Second)
+	template := ocsp.Response{Status: ocsp.Good, SerialNumber: request.SerialNumber, ThisUpdate: now.Add(-time.Second)}
+	if responder.revoked {
+		template.Status, template.RevokedAt = ocsp.Revoked, now.Add(-time.Second)
+	}
+	if responder.validity != 0 {
+		template.NextUpdate = now.Add(responder.validity)
+	}
+	raw, err := ocsp.CreateResponse(responder.issuer.cert, responder.issuer.cert, template, responder.issuer.key)
+	if err != nil {
+		responder.t.Error(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(raw)
+}
+
+func (responder *testResponder) set(validity time.Duration, down bool) {
+	responder.mu.Lock()
+	defer responder.mu.Unlock()
+	responder.validity, responder.down = validity, down
+}
+
+func (responder *testResponder) revoke() {
+	responder.mu.Lock()
+	defer responder.mu.Unlock()
+	responder.revoked = true
+}
+
+func (responder *testResponder) count() int {
+	responder.mu.Lock()
+	defer responder.mu.Unlock()
+	return responder.requests
+}
+
+func newOCSPTest(t *testing.T, validity time.Duration) (*testResponder, string, tls.Certificate) {
+	t.Helper()
+	ca := newTestCA(t)
+	leaf := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "example.com"}, DNSNames: []string{"example.com"}}, ca)
+
+	responder := &testResponder{t: t, issuer: ca, validity: validity}
+	server := httptest.NewServer(responder)
+	t.Cleanup(server.Close)
+
+	return responder, server.URL, leaf.tlsCertificate(ca)
+}
+
+func startStapler(t *testing.T, cert tls.Certificate, settings *OCSPStapling, basePath string) *ocspStapler {
+	t.Helper()
+	stapler, err := newOCSPStapler([]tls.Certificate{cert}, settings, basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stapler == nil {
+		t.Fatal("no certificate to staple")
+	}
+	t.Cleanup(stapler.Stop)
+	return stapler
+}
+
+func (stapler *ocspStapler) currentStaple() []byte {
+	cert, _ := stapler.getCertificate(&tls.ClientHelloInfo{})
+	return cert.OCSPStaple
+}
+
+func TestOCSPFetchAndCache(t *testing.T) {
+	responder, url, cert := newOCSPTest(t, time.Hour)
+	dir := t.TempDir()
+
+	stapler, err := newOCSPStapler([]tls.Certificate{cert}, &OCSPStapling{ResponderURL: url}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return stapler.currentStaple() != nil }) {
+		t.Fatal("response not stapled")
+	}
+
+	var files []string
+	if !waitFor(t, time.Second, func() bool {
+		files, _ = filepath.Glob(filepath.Join(dir, DefaultOCSPCacheDir, "*.ocsp"))
+		return len(files) == 1
+	}) {
+		t.Fatalf("response not cached, files %v", files)
+	}
+	stapler.Stop()
+
+	//a restart staples the cached response before reaching the responder
+	responder.set(time.Hour, true)
+	restarted, err := newOCSPStapler([]tls.Certificate{cert}, &OCSPStapling{ResponderURL: url}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Stop()
+	if restarted.currentStaple() == nil {
+		t.Error("cached response not stapled at start")
+	}
+}
+
+func TestOCSPRefresh(t *testing.T) {
+	//refreshed halfway through the validity
+	responder, url, cert := newOCSPTest(t, 2*time.Second)
+	startStapler(t, cert, &OCSPStapling{ResponderURL: url}, t.TempDir())
+
+	if !waitFor(t, 5*time.Second, func() bool { return responder.count() >= 2 }) {
+		t.Errorf("response not refreshed, %d requests", responder.count())
+	}
+}
+
+func TestOCSPExpiredStapleRemoved(t *testing.T) {
+	responder, url, cert := newOCSPTest(t, 2*time.Second)
+	stapler := startStapler(t, cert, &OCSPStapling{ResponderURL: url}, t.TempDir())
+
+	if !waitFor(t, 5*time.Second, func() bool { return stapler.currentStaple() != nil }) {
+		t.Fatal("response not stapled")
+	}
+	responder.set(0, true)
+
+	if !waitFor(t, 5*time.Second, func() bool { return stapler.currentStaple() == nil }) {
+		t.Error("expired staple still served while the responder is down")
+	}
+}
+
+func TestOCSPRevokedStapleRemoved(t *testing.T) {
+	responder, url, cert := newOCSPTest(t, 2*time.Second)
+	dir := t.TempDir()
+	stapler := startStapler(t, cert, &OCSPStapling{ResponderURL: url}, dir)
+
+	cached := func() bool {
+		files, _ := filepath.Glob(filepath.Join(dir, DefaultOCSPCacheDir, "*.ocsp"))
+		return len(files) != 0
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return stapler.currentStaple() != nil && cached() }) {
+		t.Fatal("response not stapled")
+	}
+	responder.revoke()
+
+	//removed at the next refresh, long before the good response expires
+	if !waitFor(t, 5*time.Second, func() bool { return stapler.currentStaple() == nil }) {
+		t.Error("staple of a revoked certificate still served")
+	}
+	if cached() {
+		t.Error("good response of a revoked certificate still cached")
+	}
+}
+
+func TestOCSPCacheDirFailure(t *testing.T) {
+	_, url, cert := newOCSPTest(t, time.Hour)
+
+	//the cache directory cannot be created below a regular file
+	base := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(base, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	stapler := startStapler(t, cert, &OCSPStapling{ResponderURL: url}, base)
+	if !waitFor(t, 5*time.Second, func() bool { return stapler.currentStaple() != nil }) {
+		t.Error("response not stapled from memory")
+	}
+}
+
+func TestOCSPWithoutResponder(t *testing.T) {
+	ca := newTestCA(t)
+	leaf := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "example.com"}}, ca)
+
+	stapler, err := newOCSPStapler([]tls.Certificate{leaf.tlsCertificate(ca)}, nil, t.TempDir())
+	if err != nil || stapler != nil {
+		t.Errorf("certificate without responder url stapled: %v, %v", stapler, err)
+	}
+}
+
+func TestOCSPOptIn(t *testing.T) {
+	_, url, cert := newOCSPTest(t, time.Hour)
+	dir := t.TempDir()
+
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[1]})...)
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "server.crt"), chain, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "server.key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ssl := []*SSL{{CertFilePath: filepath.Join(dir, "server.crt"), KeyFilePath: filepath.Join(dir, "server.key")}}
+
+	for _, settings := range []*OCSPStapling{nil, {ResponderURL: url}} {
+		bind := &Bind{SSL: ssl, OCSP: settings, conf: &Conf{BasePath: dir}}
+		if _, err := bind.serverTLSConfig(); err != nil {
+			t.Fatal(err)
+		}
+		if bind.stapler != nil {
+			bind.stapler.Stop()
+			t.Errorf("stapling enabled by %+v", settings)
+		}
+	}
+
+	bind := &Bind{SSL: ssl, OCSP: &OCSPStapling{Enable: true, ResponderURL: url}, conf: &Conf{BasePath: dir}}
+	if _, err := bind.serverTLSConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if bind.stapler == nil {
+		t.Fatal("enabled stapling not started")
+	}
+	bind.stapler.Stop()
+}
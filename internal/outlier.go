@@ -0,0 +1,284 @@
+package internal
+
+import (
+	"log/slog"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultOutlierInterval           time.Duration = 10 * time.Second
+	DefaultOutlierWindow             time.Duration = 60 * time.Second
+	DefaultOutlierBaseEjectionTime   time.Duration = 30 * time.Second
+	DefaultOutlierMaxEjectionTime    time.Duration = 5 * time.Minute
+	DefaultOutlierMinRequests        int           = 20
+	DefaultOutlierMaxEjectionPercent int           = 10
+	DefaultOutlierStdevFactor        float64       = 1.9
+	DefaultOutlierLatencyPercentile  float64       = 99
+	DefaultOutlierLatencyFactor      float64       = 3
+
+	//samples kept per endpoint, older ones are overwritten even if still inside the window
+	outlierSamplesSize = 1024
+	//success rate statistics are meaningful only with enough siblings
+	outlierSuccessRateMinHosts = 3
+)
+
+type OutlierDetection struct {
+	Interval    string `json:"interval,omitempty"`
+	Window      string `json:"window,omitempty"`
+	MinRequests int    `json:"minRequests,omitempty"`
+
+	//eject when the success rate is below mean - factor * stdev of the group success rates
+	SuccessRateStdevFactor float64 `json:"successRateStdevFactor,omitempty"`
+	//eject when the failure percentage is at least this value, 0 disables the check
+	FailurePercentThreshold float64 `json:"failurePercentThreshold,omitempty"`
+
+	//eject when the latency percentile is above factor * median of the siblings' percentile
+	LatencyPercentile float64 `json:"latencyPercentile,omitempty"`
+	LatencyFactor     float64 `json:"latencyFactor,omitempty"`
+
+	//ejection time doubles at every consecutive ejection up to maxEjectionTime
+	BaseEjectionTime string `json:"baseEjectionTime,omitempty"`
+	MaxEjectionTime  string `json:"maxEjectionTime,omitempty"`
+	//share of the group that can be ejected at the same time, rounded down but at least
+	//one endpoint when the group has more than one. 0 disables the ejection
+	MaxEjectionPercent *int `json:"maxEjectionPercent,omitempty"`
+
+	interval         time.Duration `json:"-"`
+	window           time.Duration `json:"-"`
+	baseEjectionTime time.Duration `json:"-"`
+	maxEjectionTime  time.Duration `json:"-"`
+	stop             chan struct{} `json:"-"`
+}
+
+type outlierSample struct {
+	at      time.Time
+	latency time.Duration
+	success bool
+}
+
+// sliding window of the latest requests served by an endpoint
+type outlierStats struct {
+	mu      sync.Mutex
+	samples [outlierSamplesSize]outlierSample
+	next    int
+	size    int
+
+	//unix nano, read on every balancing decision
+	ejectedUntil atomic.Int64
+	ejections    int
+}
+
+type outlierSummary struct {
+	endpoint    *Endpoint
+	successRate float64
+	latency     time.Duration
+}
+
+func (stats *outlierStats) record(latency time.Duration, success bool) {
+	stats.mu.Lock()
+	stats.samples[stats.next] = outlierSample{at: time.Now(), latency: latency, success: success}
+	stats.next = (stats.next + 1) % outlierSamplesSize
+	stats.size = min(stats.size+1, outlierSamplesSize)
+	stats.mu.Unlock()
+}
+
+// success rate and latency percentile of the samples inside the window
+func (stats *outlierStats) summarize(window time.Duration, percentile float64) (requests int, successRate float64, latency time.Duration) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	from := time.Now().Add(-window)
+	latencies := make([]time.Duration, 0, stats.size)
+	successes := 0
+	for i := range stats.size {
+		sample := stats.samples[i]
+		if sample.at.Before(from) {
+			continue
+		}
+		latencies = append(latencies, sample.latency)
+		if sample.success {
+			successes++
+		}
+	}
+
+	requests = len(latencies)
+	if requests == 0 {
+		return 0, 0, 0
+	}
+
+	slices.Sort(latencies)
+	index := int(math.Ceil(percentile/100*float64(requests))) - 1
+	return requests, float64(successes) / float64(requests), latencies[max(index, 0)]
+}
+
+func (stats *outlierStats) isEjected() bool {
+	return time.Now().UnixNano() < stats.ejectedUntil.Load()
+}
+
+func (endpoint *Endpoint) isEjected() bool {
+	return endpoint.outliers != nil && endpoint.outliers.isEjected()
+}
+
+func (od *OutlierDetection) Start(group *Group) {
+	od.interval = getWithDefaultDuration(od.Interval, DefaultOutlierInterval)
+	od.window = getWithDefaultDuration(od.Window, DefaultOutlierWindow)
+	od.baseEjectionTime = getWithDefaultDuration(od.BaseEjectionTime, DefaultOutlierBaseEjectionTime)
+	od.maxEjectionTime = getWithDefaultDuration(od.MaxEjectionTime, DefaultOutlierMaxEjectionTime)
+	od.MinRequests = getWithDefaultInt(od.MinRequests, DefaultOutlierMinRequests)
+	if od.MaxEjectionPercent == nil {
+		maxEjectionPercent := DefaultOutlierMaxEjectionPercent
+		od.MaxEjectionPercent = &maxEjectionPercent
+	}
+	if od.SuccessRateStdevFactor == 0 {
+		od.SuccessRateStdevFactor = DefaultOutlierStdevFactor
+	}
+	if od.LatencyPercentile == 0 {
+		od.LatencyPercentile = DefaultOutlierLatencyPercentile
+	}
+	if od.LatencyFactor == 0 {
+		od.LatencyFactor = DefaultOutlierLatencyFactor
+	}
+
+	for _, endpoint := range group.Endpoints {
+		endpoint.outliers = &outlierStats{}
+	}
+
+	//Stop clears od.stop, the goroutine keeps its own reference
+	stop := make(chan struct{})
+	od.stop = stop
+	go func() {
+		ticker := time.NewTicker(od.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				od.evaluate(group.Endpoints)
+			}
+		}
+	}()
+}
+
+func (od *OutlierDetection) Stop() {
+	if od.stop != nil {
+		close(od.stop)
+		od.stop = nil
+	}
+}
+
+func (od *OutlierDetection) evaluate(endpoints []*Endpoint) {
+	summaries := make([]outlierSummary, 0, len(endpoints))
+	ejected := 0
+	for _, endpoint := range endpoints {
+		if endpoint.outliers.isEjected() {
+			ejected++
+			continue
+		}
+
+		requests, successRate, latency := endpoint.outliers.summarize(od.window, od.LatencyPercentile)
+		if requests >= od.MinRequests {
+			summaries = append(summaries, outlierSummary{endpoint: endpoint, successRate: successRate, latency: latency})
+		}
+	}
+
+	maxEjected := len(endpoints) * max(*od.MaxEjectionPercent, 0) / 100
+	if maxEjected == 0 && *od.MaxEjectionPercent > 0 && len(endpoints) > 1 {
+		maxEjected = 1
+	}
+
+	successThreshold := -1.0
+	if len(summaries) >= outlierSuccessRateMinHosts {
+		mean, stdev := successRateStats(summaries)
+		successThreshold = mean - od.SuccessRateStdevFactor*stdev
+	}
+
+	outliers := make(map[*Endpoint]bool)
+	for i, summary := range summaries {
+		reason := ""
+		switch {
+		case summary.successRate < successThreshold:
+			reason = "success rate"
+		case od.FailurePercentThreshold > 0 && (1-summary.successRate)*100 >= od.FailurePercentThreshold:
+			reason = "failure percentage"
+		case od.isSlow(summaries, i):
+			reason = "latency"
+		}
+
+		if reason == "" {
+			continue
+		}
+		outliers[summary.endpoint] = true
+
+		if ejected >= maxEjected {
+			slog.Debug("outlier not ejected, max ejection percentage reached", "endpoint", summary.endpoint.Address, "reason", reason)
+			continue
+		}
+
+		ejected++
+		duration := od.eject(summary.endpoint)
+		slog.Info("endpoint ejected as outlier", "endpoint", summary.endpoint.Address, "reason", reason,
+			"successRate", summary.successRate, "latency", summary.latency, "duration", duration)
+	}
+
+	//endpoints behaving well for a whole interval slowly recover their ejection multiplier
+	for _, endpoint := range endpoints {
+		stats := endpoint.outliers
+		stats.mu.Lock()
+		if !outliers[endpoint] && !stats.isEjected() && stats.ejections > 0 {
+			stats.ejections--
+		}
+		stats.mu.Unlock()
+	}
+}
+
+func (od *OutlierDetection) isSlow(summaries []outlierSummary, index int) bool {
+	siblings := make([]time.Duration, 0, len(summaries)-1)
+	for i, summary := range summaries {
+		if i != index {
+			siblings = append(siblings, summary.latency)
+		}
+	}
+
+	if len(siblings) == 0 {
+		return false
+	}
+
+	slices.Sort(siblings)
+	median := siblings[len(siblings)/2]
+	return float64(summaries[index].latency) > od.LatencyFactor*float64(median)
+}
+
+func (od *OutlierDetection) eject(endpoint *Endpoint) time.Duration {
+	stats := endpoint.outliers
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	duration := od.baseEjectionTime << min(stats.ejections, 16)
+	if duration > od.maxEjectionTime || duration <= 0 {
+		duration = od.maxEjectionTime
+	}
+
+	stats.ejections++
+	stats.ejectedUntil.Store(time.Now().Add(duration).UnixNano())
+	//samples collected before the ejection must not cause a new one once back
+	stats.size = 0
+	stats.next = 0
+	return duration
+}
+
+func successRateStats(summaries []outlierSummary) (mean float64, stdev float64) {
+	for _, summary := range summaries {
+		mean += summary.successRate
+	}
+	mean /= float64(len(summaries))
+
+	for _, summary := range summaries {
+		stdev += (summary.successRate - mean) * (summary.successRate - mean)
+	}
+	return mean, math.Sqrt(stdev / float64(len(summaries)))
+}
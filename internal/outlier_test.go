@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func outlierEndpoints(t *testing.T, od *OutlierDetection, successes ...int) []*Endpoint {
+	t.Helper()
+	endpoints := make([]*Endpoint, len(successes))
+	for i := range successes {
+		endpoints[i] = &Endpoint{Address: fmt.Sprintf("http://%d", i)}
+	}
+
+	od.Start(&Group{Endpoints: endpoints})
+	t.Cleanup(od.Stop)
+
+	//100 requests per endpoint, the first `success` ones succeed
+	for i, success := range successes {
+		for n := range 100 {
+			endpoints[i].outliers.record(10*time.Millisecond, n < success)
+		}
+	}
+	return endpoints
+}
+
+func ejectedCount(endpoints []*Endpoint) int {
+	count := 0
+	for _, endpoint := range endpoints {
+		if endpoint.isEjected() {
+			count++
+		}
+	}
+	return count
+}
+
+func TestOutlierSummarize(t *testing.T) {
+	stats := &outlierStats{}
+	for i := range 100 {
+		stats.record(time.Duration(i+1)*time.Millisecond, i%4 != 0)
+	}
+
+	requests, successRate, latency := stats.summarize(time.Minute, 99)
+	if requests != 100 || successRate != 0.75 || latency != 99*time.Millisecond {
+		t.Errorf("summarize = %d, %v, %v, want 100, 0.75, 99ms", requests, successRate, latency)
+	}
+
+	stats.samples[0].at = time.Now().Add(-2 * time.Minute)
+	if requests, _, _ := stats.summarize(time.Minute, 99); requests != 99 {
+		t.Errorf("samples outside the window counted, %d requests", requests)
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	tests := []struct {
+		name    string
+		percent *int
+		want    int
+	}{
+		{"default allows one endpoint out of two", nil, 1},
+		{"zero disables ejection", ptr(0), 0},
+		{"half of the group", ptr(50), 1},
+		{"whole group", ptr(100), 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			od := &OutlierDetection{Interval: "1h", FailurePercentThreshold: 50, MaxEjectionPercent: test.percent}
+			endpoints := outlierEndpoints(t, od, 10, 20)
+
+			od.evaluate(endpoints)
+			if got := ejectedCount(endpoints); got != test.want {
+				t.Errorf("%d endpoints ejected, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOutlierDefaultEjection(t *testing.T) {
+	od := &OutlierDetection{Interval: "1h", FailurePercentThreshold: 50}
+	endpoints := outlierEndpoints(t, od, 0, 100)
+
+	od.evaluate(endpoints)
+	if !endpoints[0].isEjected() || ejectedCount(endpoints) != 1 {
+		t.Errorf("failing endpoint of a pair not ejected with the default settings")
+	}
+
+	//the last endpoint of a group is never ejected
+	od = &OutlierDetection{Interval: "1h", FailurePercentThreshold: 50}
+	endpoints = outlierEndpoints(t, od, 0)
+	od.evaluate(endpoints)
+	if ejectedCount(endpoints) != 0 {
+		t.Error("single endpoint ejected")
+	}
+}
+
+func TestOutlierSuccessRate(t *testing.T) {
+	od := &OutlierDetection{Interval: "1h", MaxEjectionPercent: ptr(50)}
+	endpoints := outlierEndpoints(t, od, 100, 100, 100, 100, 40)
+
+	od.evaluate(endpoints)
+	if !endpoints[4].isEjected() || ejectedCount(endpoints) != 1 {
+		t.Errorf("only the endpoint with a low success rate must be ejected")
+	}
+}
+
+func TestOutlierLatency(t *testing.T) {
+	od := &OutlierDetection{Interval: "1h", MaxEjectionPercent: ptr(50)}
+	endpoints := outlierEndpoints(t, od, 100, 100, 100)
+	for range 100 {
+		endpoints[2].outliers.record(time.Second, true)
+	}
+
+	od.evaluate(endpoints)
+	if !endpoints[2].isEjected() || ejectedCount(endpoints) != 1 {
+		t.Errorf("only the slow endpoint must be ejected")
+	}
+}
+
+func TestOutlierEjectionBackoff(t *testing.T) {
+	od := &OutlierDetection{BaseEjectionTime: "1s", MaxEjectionTime: "5s"}
+	endpoints := outlierEndpoints(t, od, 100)
+
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second} {
+		if got := od.eject(endpoints[0]); got != want {
+			t.Errorf("ejection time = %v, want %v", got, want)
+		}
+	}
+	if requests, _, _ := endpoints[0].outliers.summarize(time.Minute, 99); requests != 0 {
+		t.Error("samples collected before the ejection were kept")
+	}
+}
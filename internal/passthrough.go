@@ -0,0 +1,314 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	tlsRecordHandshake  = 0x16
+	tlsClientHello      = 0x01
+	tlsExtServerName    = 0
+	tlsExtALPN          = 16
+	tlsRecordHeaderSize = 5
+	//handshake messages have a 24 bit length, real ClientHellos stay far below this
+	maxClientHelloSize = 1 << 16
+	//bytes read from the connection, records headers included, before giving up on the
+	//ClientHello. Leaves room for the header of one record per KiB
+	maxClientHelloPeek = maxClientHelloSize + 4 + (maxClientHelloSize>>10+1)*tlsRecordHeaderSize
+)
+
+var (
+	errMalformedClientHello = errors.New("malformed ClientHello")
+	errClientHelloTooLarge  = errors.New("ClientHello too large")
+)
+
+// server name and protocols offered by the client, read before choosing who terminates TLS
+type clientHello struct {
+	serverName string
+	alpn       []string
+}
+
+// reads the records holding the ClientHello, head is every byte read from the connection.
+// A connection not starting with a TLS handshake record returns a nil hello and no error
+func peekClientHello(conn net.Conn) (*clientHello, []byte, error) {
+	var head bytes.Buffer
+	limited := &io.LimitedReader{R: conn, N: maxClientHelloPeek}
+	r := io.TeeReader(limited, &head)
+	read := func(p []byte) error {
+		_, err := io.ReadFull(r, p)
+		if err != nil && limited.N == 0 {
+			return errClientHelloTooLarge
+		}
+		return err
+	}
+
+	header := make([]byte, tlsRecordHeaderSize)
+	if err := read(header[:1]); err != nil {
+		return nil, head.Bytes(), err
+	}
+	if header[0] != tlsRecordHandshake {
+		return nil, head.Bytes(), nil
+	}
+	if err := read(header[1:]); err != nil {
+		return nil, head.Bytes(), err
+	}
+
+	//a ClientHello may span several records
+	var handshake []byte
+	for {
+		//empty handshake records are forbidden (RFC 8446 5.1)
+		size := binary.BigEndian.Uint16(header[3:])
+		if header[0] != tlsRecordHandshake || size == 0 {
+			return nil, head.Bytes(), errMalformedClientHello
+		}
+		record := make([]byte, size)
+		if err := read(record); err != nil {
+			return nil, head.Bytes(), err
+		}
+		handshake = append(handshake, record...)
+
+		if len(handshake) >= 4 {
+			if handshake[0] != tlsClientHello {
+				return nil, head.Bytes(), errMalformedClientHello
+			}
+			size := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+			if size > maxClientHelloSize {
+				return nil, head.Bytes(), errClientHelloTooLarge
+			}
+			if len(handshake) >= 4+size {
+				hello, err := parseClientHello(handshake[4 : 4+size])
+				return hello, head.Bytes(), err
+			}
+		}
+
+		if err := read(header); err != nil {
+			return nil, head.Bytes(), err
+		}
+	}
+}
+
+// only the server_name and application_layer_protocol_negotiation extensions are read
+func parseClientHello(message []byte) (*clientHello, error) {
+	s := cryptobyte.String(message)
+	var version uint16
+	var sessionID, cipherSuites, compression, extensions cryptobyte.String
+	if !s.ReadUint16(&version) || !s.Skip(32) ||
+		!s.ReadUint8LengthPrefixed(&sessionID) ||
+		!s.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!s.ReadUint8LengthPrefixed(&compression) {
+		return nil, errMalformedClientHello
+	}
+
+	hello := &clientHello{}
+	if s.Empty() {
+		return hello, nil
+	}
+	if !s.ReadUint16LengthPrefixed(&extensions) {
+		return nil, errMalformedClientHello
+	}
+
+	for !extensions.Empty() {
+		var extension uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, errMalformedClientHello
+		}
+
+		switch extension {
+		case tlsExtServerName:
+			var names cryptobyte.String
+			if !data.ReadUint16LengthPrefixed(&names) {
+				return nil, errMalformedClientHello
+			}
+			for !names.Empty() {
+				var nameType uint8
+				var name cryptobyte.String
+				if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+					return nil, errMalformedClientHello
+				}
+				//0 is host_name, the only type defined
+				if nameType == 0 {
+					hello.serverName = strings.ToLower(string(name))
+				}
+			}
+		case tlsExtALPN:
+			var protocols cryptobyte.String
+			if !data.ReadUint16LengthPrefixed(&protocols) {
+				return nil, errMalformedClientHello
+			}
+			for !protocols.Empty() {
+				var protocol cryptobyte.String
+				if !protocols.ReadUint8LengthPrefixed(&protocol) {
+					return nil, errMalformedClientHello
+				}
+				hello.alpn = append(hello.alpn, string(protocol))
+			}
+		}
+	}
+	return hello, nil
+}
+
+// passthrough group of the server name, the last matching one like grabGroup. A group
+// with an ALPN list also needs the client to offer one of its protocols
+func grabPassthroughGroup(g []*Group, hello *clientHello) *Group {
+	var group *Group
+	for _, currentGroup := range g {
+		if !currentGroup.TLSPassthrough || !strings.EqualFold(currentGroup.Address, hello.serverName) {
+			continue
+		}
+		if alpn := currentGroup.Layer4.ALPN; len(alpn) != 0 &&
+			!slices.ContainsFunc(hello.alpn, func(protocol string) bool { return slices.Contains(alpn, protocol) }) {
+			continue
+		}
+		group = currentGroup
+	}
+	return group
+}
+
+func (bind *Bind) hasPassthrough() bool {
+	return slices.ContainsFunc(bind.Groups, func(group *Group) bool { return group.TLSPassthrough })
+}
+
+// replays the bytes read while peeking the ClientHello
+type replayConn struct {
+	net.Conn
+	head []byte
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	if len(c.head) == 0 {
+		return c.Conn.Read(p)
+	}
+	n := copy(p, c.head)
+	c.head = c.head[n:]
+	return n, nil
+}
+
+// routes the connection by its ClientHello: a passthrough group match is spliced to the
+// group endpoints, false gives the connection and the bytes read back to the caller
+func (bind *Bind) passthrough(conn net.Conn) (bool, []byte) {
+	conn.SetReadDeadline(time.Now().Add(getWithDefaultDuration(bind.ReadHeaderTimeout, DefaultReadHeaderTimeout)))
+	hello, head, err := peekClientHello(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		slog.Debug("cannot read ClientHello", "bind", bind.Address, "client", conn.RemoteAddr(), "error", err)
+		return false, head
+	}
+	if hello == nil {
+		return false, head
+	}
+
+	group := grabPassthroughGroup(bind.Groups, hello)
+	if group == nil {
+		return false, head
+	}
+
+	slog.Debug("tls passthrough", "bind", bind.Address, "sni", hello.serverName, "alpn", hello.alpn)
+	group.proxyRaw(bind.Address, conn, head)
+	return true, nil
+}
+
+// listener of an HTTP bind with passthrough groups: the connections not taken by
+// passthrough are returned by Accept, replaying the peeked bytes
+type passthroughListener struct {
+	net.Listener
+	bind *Bind
+	//tracks the connections while they are peeked and spliced
+	raw *rawServer
+
+	conns     chan net.Conn
+	done      chan struct{}
+	acceptErr error
+	closeOnce sync.Once
+}
+
+func (bind *Bind) newPassthroughListener(ln net.Listener) *passthroughListener {
+	pl := &passthroughListener{
+		Listener: ln,
+		bind:     bind,
+		raw:      &rawServer{bind: bind, conns: make(map[net.Conn]struct{})},
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	bind.raw = pl.raw
+	go pl.serve()
+	return pl
+}
+
+func (pl *passthroughListener) serve() {
+	var backoff time.Duration
+	for {
+		conn, err := pl.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				pl.closeOnce.Do(func() {
+					pl.acceptErr = err
+					close(pl.done)
+				})
+				return
+			}
+
+			backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+			slog.Error("accept error on bind", "bind", pl.bind.Address, "error", err, "retry", backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		if !pl.raw.track(conn) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer pl.raw.untrack(conn)
+			pl.dispatch(conn)
+		}()
+	}
+}
+
+func (pl *passthroughListener) dispatch(conn net.Conn) {
+	var spliced bool
+	var head []byte
+	panicked := catchUnwind(func() {
+		spliced, head = pl.bind.passthrough(conn)
+	})
+	if spliced || panicked {
+		conn.Close()
+		return
+	}
+
+	select {
+	case pl.conns <- &replayConn{Conn: conn, head: head}:
+	case <-pl.done:
+		conn.Close()
+	}
+}
+
+func (pl *passthroughListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case <-pl.done:
+		return nil, pl.acceptErr
+	}
+}
+
+func (pl *passthroughListener) Close() error {
+	err := pl.Listener.Close()
+	pl.closeOnce.Do(func() {
+		pl.acceptErr = net.ErrClosed
+		close(pl.done)
+	})
+	return err
+}
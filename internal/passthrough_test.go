@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// ClientHello handshake message sent by a crypto/tls client, without record header
+func clientHelloMessage(t *testing.T, config *tls.Config) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, config).Handshake()
+		client.Close()
+	}()
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, tlsRecordHeaderSize)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	message := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(server, message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+// handshake records carrying message in chunks of size bytes
+func handshakeRecords(message []byte, size int) []byte {
+	var records []byte
+	for len(message) > 0 {
+		chunk := message[:min(size, len(message))]
+		message = message[len(chunk):]
+		records = append(records, tlsRecordHandshake, 3, 1, byte(len(chunk)>>8), byte(len(chunk)))
+		records = append(records, chunk...)
+	}
+	return records
+}
+
+// peeks data as sent by a client, followed by the bytes of its first request
+func peek(t *testing.T, data []byte) (*clientHello, []byte, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return peekClientHello(server)
+}
+
+func TestPeekClientHello(t *testing.T) {
+	message := clientHelloMessage(t, &tls.Config{ServerName: "API.example.com", NextProtos: []string{"h2", "http/1.1"}})
+
+	for _, size := range []int{len(message), 100, 1} {
+		records := handshakeRecords(message, size)
+		hello, head, err := peek(t, records)
+		if err != nil {
+			t.Fatalf("records of %d bytes: %v", size, err)
+		}
+		if hello.serverName != "api.example.com" || !slices.Equal(hello.alpn, []string{"h2", "http/1.1"}) {
+			t.Errorf("records of %d bytes: hello = %+v", size, hello)
+		}
+		if !bytes.Equal(head, records) {
+			t.Errorf("records of %d bytes: %d bytes peeked, want %d", size, len(head), len(records))
+		}
+	}
+
+	hello, head, err := peek(t, []byte("GET / HTTP/1.1\r\n\r\n"))
+	if hello != nil || err != nil || string(head) != "G" {
+		t.Errorf("plain HTTP: hello = %v, head = %q, error %v", hello, head, err)
+	}
+}
+
+func TestPeekClientHelloErrors(t *testing.T) {
+	message := clientHelloMessage(t, &tls.Config{ServerName: "example.com"})
+
+	//version, random and empty session id, cipher suites and compression methods
+	body := make([]byte, 38)
+	//extensions announcing 5 bytes that never come
+	body = append(body, 0, 5)
+
+	tests := map[string][]byte{
+		"empty record":         append([]byte{tlsRecordHandshake, 3, 1, 0, 0}, handshakeRecords(message, len(message))...),
+		"alert record":         append(handshakeRecords(message[:10], 10), 0x15, 3, 1, 0, 2, 2, 40),
+		"not a ClientHello":    handshakeRecords(append([]byte{0x02}, message[1:]...), len(message)),
+		"truncated message":    handshakeRecords(message[:len(message)-1], len(message)),
+		"oversized message":    handshakeRecords([]byte{tlsClientHello, 0x01, 0x00, 0x01}, 4),
+		"malformed extensions": handshakeRecords(append([]byte{tlsClientHello, 0, 0, byte(len(body))}, body...), 100),
+	}
+	for name, data := range tests {
+		if hello, _, err := peek(t, data); err == nil {
+			t.Errorf("%s: accepted, hello %+v", name, hello)
+		}
+	}
+}
+
+func TestPeekClientHelloLimit(t *testing.T) {
+	//a ClientHello of the largest size sent a byte per record costs six times its size
+	message := append([]byte{tlsClientHello, 0x01, 0x00, 0x00}, make([]byte, maxClientHelloSize)...)
+	_, head, err := peek(t, handshakeRecords(message, 1))
+	if !errors.Is(err, errClientHelloTooLarge) {
+		t.Errorf("error = %v, want %v", err, errClientHelloTooLarge)
+	}
+	if len(head) > maxClientHelloPeek {
+		t.Errorf("%d bytes peeked, limit %d", len(head), maxClientHelloPeek)
+	}
+}
+
+func TestGrabPassthroughGroup(t *testing.T) {
+	every := &Group{TLSPassthrough: true, Address: "example.com", Layer4: &Layer4{}}
+	h2 := &Group{TLSPassthrough: true, Address: "example.com", Layer4: &Layer4{ALPN: []string{"h2"}}}
+	plain := &Group{Address: "example.com", Layer4: &Layer4{}}
+	groups := []*Group{every, h2, plain}
+
+	tests := []struct {
+		hello *clientHello
+		want  *Group
+	}{
+		{&clientHello{serverName: "example.com", alpn: []string{"h2"}}, h2},
+		{&clientHello{serverName: "example.com", alpn: []string{"http/1.1"}}, every},
+		{&clientHello{serverName: "example.com"}, every},
+		{&clientHello{serverName: "other.com"}, nil},
+	}
+	for _, test := range tests {
+		if got := grabPassthroughGroup(groups, test.hello); got != test.want {
+			t.Errorf("hello %+v: group %p, want %p", test.hello, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"errors"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"minibalancer/balancer"
+)
+
+const (
+	//time constant of the exponential decay
+	peakEwmaDecay time.Duration = 10 * time.Second
+	//cost of an endpoint with requests in flight but no latency observed yet, and of a failed request
+	peakEwmaPenalty time.Duration = time.Second
+)
+
+// peak exponentially weighted moving average of the response time: a slower response
+// is taken immediately, faster ones are averaged in, and the cost decays towards zero
+// when the endpoint receives no traffic so that it gets probed again
+type ewmaStats struct {
+	mu    sync.Mutex
+	cost  float64
+	stamp time.Time
+}
+
+func (stats *ewmaStats) observe(rtt time.Duration) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	now := time.Now()
+	sample := float64(rtt)
+	if sample > stats.cost {
+		stats.cost = sample
+	} else {
+		w := math.Exp(-float64(now.Sub(stats.stamp)) / float64(peakEwmaDecay))
+		stats.cost = stats.cost*w + sample*(1-w)
+	}
+	stats.stamp = now
+}
+
+func (stats *ewmaStats) get() float64 {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	return stats.cost * math.Exp(-float64(time.Since(stats.stamp))/float64(peakEwmaDecay))
+}
+
+// load combining the latency estimate and the requests in flight, scaled by the effective weight
+func (endpoint *Endpoint) peakEwmaLoad() float64 {
+	pending := float64(endpoint.ActiveConnections.Load())
+	cost := endpoint.latency.get()
+
+	var load float64
+	if cost == 0 && pending != 0 {
+		load = float64(peakEwmaPenalty) + pending
+	} else {
+		load = cost * (pending + 1)
+	}
+	return weightedLoad(load, endpoint.EffectiveWeight())
+}
+
+type peakEwma struct {
+}
+
+// power of two choices between healthy endpoints by peak ewma load
+func (peakEwma *peakEwma) Balance(_ *http.Request, endpoints []balancer.Endpoint) (balancer.Endpoint, error) {
+	a, b := pickTwo(endpoints)
+	if b == nil {
+		return a, nil
+	}
+
+	endpointA, okA := a.(*Endpoint)
+	endpointB, okB := b.(*Endpoint)
+	if !okA || !okB || endpointA.latency == nil || endpointB.latency == nil {
+		return nil, errors.New("peak ewma requires latency tracking on endpoints")
+	}
+
+	if endpointA.peakEwmaLoad() <= endpointB.peakEwmaLoad() {
+		return a, nil
+	}
+	return b, nil
+}
+
+// two distinct random endpoints, b is nil when there is only one
+func pickTwo(endpoints []balancer.Endpoint) (a balancer.Endpoint, b balancer.Endpoint) {
+	if len(endpoints) == 1 {
+		return endpoints[0], nil
+	}
+
+	i := rand.IntN(len(endpoints))
+	j := rand.IntN(len(endpoints) - 1)
+	if j >= i {
+		j++
+	}
+	return endpoints[i], endpoints[j]
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"minibalancer/balancer"
+)
+
+func latencyEndpoint(address string, rtt time.Duration) *Endpoint {
+	endpoint := &Endpoint{Address: address, latency: &ewmaStats{stamp: time.Now()}}
+	endpoint.Alive.Store(true)
+	if rtt != 0 {
+		endpoint.latency.observe(rtt)
+	}
+	return endpoint
+}
+
+func TestEwmaPeak(t *testing.T) {
+	stats := &ewmaStats{stamp: time.Now()}
+	stats.observe(10 * time.Millisecond)
+	stats.observe(100 * time.Millisecond)
+	//a slower sample is taken at once, a faster one right after barely moves the estimate
+	stats.observe(time.Millisecond)
+	if cost := time.Duration(stats.get()); cost < 90*time.Millisecond || cost > 100*time.Millisecond {
+		t.Errorf("cost = %v, want the 100ms peak", cost)
+	}
+
+	//the cost decays when the endpoint receives no traffic
+	stats.stamp = stats.stamp.Add(-peakEwmaDecay)
+	if cost := time.Duration(stats.get()); cost > 40*time.Millisecond {
+		t.Errorf("cost = %v after a decay period", cost)
+	}
+}
+
+func TestPeakEwmaPrefersFastEndpoint(t *testing.T) {
+	fast := latencyEndpoint("fast", 5*time.Millisecond)
+	slow := latencyEndpoint("slow", 200*time.Millisecond)
+	endpoints := []balancer.Endpoint{slow, fast}
+
+	for range 100 {
+		chosen, err := (&peakEwma{}).Balance(nil, endpoints)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chosen != fast {
+			t.Fatalf("slow endpoint chosen")
+		}
+	}
+
+	//requests in flight on the fast endpoint shift the load to the slow one
+	fast.ActiveConnections.Store(100)
+	if chosen, _ := (&peakEwma{}).Balance(nil, endpoints); chosen != slow {
+		t.Error("busy fast endpoint still chosen")
+	}
+}
+
+func TestPeakEwmaUnobservedEndpoint(t *testing.T) {
+	observed := latencyEndpoint("observed", 50*time.Millisecond)
+	//pending requests without any response yet cost the penalty
+	pending := latencyEndpoint("pending", 0)
+	pending.ActiveConnections.Store(1)
+
+	chosen, err := (&peakEwma{}).Balance(nil, []balancer.Endpoint{pending, observed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chosen != observed {
+		t.Error("endpoint with unanswered requests chosen")
+	}
+
+	//an idle endpoint never observed is probed first
+	idle := latencyEndpoint("idle", 0)
+	if chosen, _ := (&peakEwma{}).Balance(nil, []balancer.Endpoint{observed, idle}); chosen != idle {
+		t.Error("idle endpoint not probed")
+	}
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	PROXY_PROTOCOL_V1 = "v1"
+	PROXY_PROTOCOL_V2 = "v2"
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+func validProxyProtocol(version string) error {
+	switch strings.ToLower(version) {
+	case "", PROXY_PROTOCOL_V1, PROXY_PROTOCOL_V2:
+		return nil
+	}
+	return fmt.Errorf("unknown PROXY protocol version %q", version)
+}
+
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+// header telling the endpoint the real client address, src is the client and dst the
+// address it connected to. v1 only describes TCP, UDP flows need v2
+func proxyProtocolHeader(version string, src net.Addr, dst net.Addr) ([]byte, error) {
+	srcIP, srcPort := addrIPPort(src)
+	dstIP, dstPort := addrIPPort(dst)
+	if srcIP == nil || dstIP == nil {
+		return nil, fmt.Errorf("PROXY protocol needs IP addresses, got %s and %s", src, dst)
+	}
+
+	_, udp := src.(*net.UDPAddr)
+	//IPv4-mapped addresses of a dual stack listener are described as IPv4
+	ipv4 := srcIP.To4() != nil && dstIP.To4() != nil
+	//a single family is allowed per header, v1 says UNKNOWN and v2 maps the IPv4 side
+	mixed := (srcIP.To4() != nil) != (dstIP.To4() != nil)
+
+	switch strings.ToLower(version) {
+	case PROXY_PROTOCOL_V1:
+		if udp {
+			return nil, fmt.Errorf("PROXY protocol v1 does not support UDP")
+		}
+		if mixed {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		family := "TCP6"
+		if ipv4 {
+			family = "TCP4"
+			srcIP, dstIP = srcIP.To4(), dstIP.To4()
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcPort, dstPort)), nil
+	case PROXY_PROTOCOL_V2:
+		//version 2, PROXY command
+		header := append([]byte(nil), proxyProtocolV2Signature...)
+		header = append(header, 0x21)
+
+		//address family in the high nibble, transport in the low one
+		family := byte(0x20)
+		var addresses []byte
+		if ipv4 {
+			family = 0x10
+			addresses = append(append(addresses, srcIP.To4()...), dstIP.To4()...)
+		} else {
+			addresses = append(append(addresses, srcIP.To16()...), dstIP.To16()...)
+		}
+		if udp {
+			family |= 0x02
+		} else {
+			family |= 0x01
+		}
+		addresses = binary.BigEndian.AppendUint16(addresses, uint16(srcPort))
+		addresses = binary.BigEndian.AppendUint16(addresses, uint16(dstPort))
+
+		header = append(header, family)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+		return append(header, addresses...), nil
+	}
+	return nil, fmt.Errorf("unknown PROXY protocol version %q", version)
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestProxyProtocolV1(t *testing.T) {
+	tcp := func(address string) net.Addr {
+		addr, err := net.ResolveTCPAddr("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr
+	}
+
+	tests := []struct {
+		name string
+		src  net.Addr
+		dst  net.Addr
+		want string
+	}{
+		{"ipv4", tcp("192.0.2.1:51000"), tcp("198.51.100.1:443"), "PROXY TCP4 192.0.2.1 198.51.100.1 51000 443\r\n"},
+		{"ipv6", tcp("[2001:db8::1]:51000"), tcp("[2001:db8::2]:443"), "PROXY TCP6 2001:db8::1 2001:db8::2 51000 443\r\n"},
+		{"ipv4-mapped on both sides", tcp("[::ffff:192.0.2.1]:51000"), tcp("[::ffff:198.51.100.1]:443"), "PROXY TCP4 192.0.2.1 198.51.100.1 51000 443\r\n"},
+		{"ipv4-mapped client on ipv6 listener", tcp("[::ffff:192.0.2.1]:51000"), tcp("[2001:db8::2]:443"), "PROXY UNKNOWN\r\n"},
+		{"ipv6 client on ipv4 listener", tcp("[2001:db8::1]:51000"), tcp("198.51.100.1:443"), "PROXY UNKNOWN\r\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header, err := proxyProtocolHeader("V1", test.src, test.dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(header) != test.want {
+				t.Errorf("header = %q, want %q", header, test.want)
+			}
+		})
+	}
+
+	udp := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+	if _, err := proxyProtocolHeader(PROXY_PROTOCOL_V1, udp, udp); err == nil {
+		t.Error("v1 header built for udp")
+	}
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51000}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+
+	header, err := proxyProtocolHeader(PROXY_PROTOCOL_V2, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]byte(nil), proxyProtocolV2Signature...),
+		0x21,       //version 2, PROXY
+		0x11,       //AF_INET, STREAM
+		0x00, 0x0c, //12 bytes of addresses
+		192, 0, 2, 1,
+		198, 51, 100, 1,
+		0xc7, 0x38, //51000
+		0x01, 0xbb, //443
+	)
+	if !bytes.Equal(header, want) {
+		t.Errorf("header = %x, want %x", header, want)
+	}
+
+	udpSrc := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5353}
+	udpDst := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 53}
+	header, err = proxyProtocolHeader(PROXY_PROTOCOL_V2, udpSrc, udpDst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//AF_INET6 and DGRAM, the IPv4 destination is mapped
+	if header[13] != 0x22 || header[14] != 0 || header[15] != 36 || len(header) != 16+36 {
+		t.Fatalf("unexpected header %x", header)
+	}
+	if got := net.IP(header[32:48]); !got.Equal(udpDst.IP) {
+		t.Errorf("destination = %v, want %v", got, udpDst.IP)
+	}
+}
+
+func TestProxyProtocolErrors(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}
+	if _, err := proxyProtocolHeader("v3", src, src); err == nil {
+		t.Error("unknown version accepted")
+	}
+	if _, err := proxyProtocolHeader(PROXY_PROTOCOL_V1, &net.UnixAddr{Name: "/tmp/s"}, src); err == nil {
+		t.Error("header built without IP addresses")
+	}
+	for _, version := range []string{"", "v1", "V2"} {
+		if err := validProxyProtocol(version); err != nil {
+			t.Errorf("version %q rejected: %v", version, err)
+		}
+	}
+	if err := validProxyProtocol("v3"); err == nil {
+		t.Error("version v3 accepted")
+	}
+}
@@ -1,68 +1,217 @@
 package internal
 
 import (
-	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
-	"strings"
+	"time"
 )
 
+const (
+	sessionIDSize  = 8
+	sessionMacSize = 16
+	//endpoint id followed by the expiry as unix seconds
+	sessionPayloadSize = sessionIDSize + 8
+	//shorter secrets, like the words found in examples, can be guessed and cookies forged
+	minSessionSecretSize = 32
+)
+
+// defaults shared by all groups, each group can override the cookie attributes
+// with typed fields, see SessionCookie
 type StatelessSessionPersistence struct {
-	CookieName     string   `json:"cookieName"`
+	CookieName string `json:"cookieName"`
+	//legacy free form attributes, e.g. "HttpOnly" or "SameSite=Strict"
 	CookieSettings []string `json:"cookieSettings"`
+	//keys used to sign the cookie, the first one signs new cookies while all of them
+	//are accepted, so a new key can be prepended and the old one removed later. Each
+	//one is at least 32 random bytes, hex or base64 encoded (openssl rand -base64 32)
+	Secrets []string `json:"secrets,omitempty"`
+	//hides the endpoint identity to the client
+	Encrypt bool `json:"encrypt,omitempty"`
+	//validity of the session embedded in the cookie, e.g. "24h", empty means no expiry
+	TTL string `json:"ttl,omitempty"`
+
+	keys []sessionKey  `json:"-"`
+	ttl  time.Duration `json:"-"`
 }
 
-func (s StatelessSessionPersistence) getStatelessPersistentSessionCookieName() string {
-	if s.CookieName == "" {
-		return "_gbsps"
+type sessionKey struct {
+	mac  []byte
+	aead cipher.AEAD
+}
+
+// derives a signing and an encryption key from every secret, when no secret is configured
+// a random one is generated and sessions do not survive a restart
+func (s *StatelessSessionPersistence) Start(used bool) error {
+	secrets := make([][]byte, 0, len(s.Secrets))
+	for _, encoded := range s.Secrets {
+		secret, err := decodeSessionSecret(encoded)
+		if err != nil {
+			return err
+		}
+		secrets = append(secrets, secret)
 	}
+	if len(secrets) == 0 {
+		random := make([]byte, minSessionSecretSize)
+		if _, err := rand.Read(random); err != nil {
+			return err
+		}
+		if used {
+			slog.Warn("no session persistence secret configured, sessions will not survive a restart nor be shared between instances")
+		}
+		secrets = append(secrets, random)
+	}
+
+	s.keys = make([]sessionKey, 0, len(secrets))
+	for _, secret := range secrets {
+		block, err := aes.NewCipher(deriveKey(secret, "minibalancer session encryption"))
+		if err != nil {
+			return err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
 
-	return s.CookieName
+		s.keys = append(s.keys, sessionKey{mac: deriveKey(secret, "minibalancer session signature"), aead: aead})
+	}
+
+	return nil
 }
 
-func (s StatelessSessionPersistence) getCookie(r *http.Request) (string, error) {
-	var cookieVal string
-	for _, c := range r.Cookies() {
-		if c.Name == s.getStatelessPersistentSessionCookieName() {
-			cookieVal = c.Value
-			break
-		}
+// hex first, like the session ticket keys
+func decodeSessionSecret(encoded string) ([]byte, error) {
+	secret, err := hex.DecodeString(encoded)
+	if err != nil {
+		secret, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil || len(secret) < minSessionSecretSize {
+		return nil, fmt.Errorf("session persistence secrets must be at least %d random bytes, hex or base64 encoded", minSessionSecretSize)
 	}
+	return secret, nil
+}
 
-	if cookieVal != "" {
-		return cookieVal, nil
+func deriveKey(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// stable identity of an endpoint inside a group, never sent in clear when encryption is enabled
+func sessionID(endpoint *Endpoint, group *Group) []byte {
+	hash := sha256.New()
+	hash.Write([]byte(endpoint.Address))
+	hash.Write([]byte{0})
+	hash.Write([]byte(group.Path))
+	return hash.Sum(nil)[:sessionIDSize]
+}
+
+func (s *StatelessSessionPersistence) getCookie(r *http.Request, name string) (string, error) {
+	c, err := r.Cookie(name)
+	if err != nil || c.Value == "" {
+		return "", errors.New("no persistent session cookie found")
 	}
-	return "", errors.New("no persistent session cookie found")
+	return c.Value, nil
 }
 
-func (s StatelessSessionPersistence) setCookie(w http.ResponseWriter, group *Group, endpoint *Endpoint) {
-	var buffer bytes.Buffer
+// the value is always produced with the first (current) key
+func (s *StatelessSessionPersistence) encode(endpoint *Endpoint, ttl time.Duration) (string, error) {
+	payload := make([]byte, sessionPayloadSize)
+	copy(payload, endpoint.sessionID)
+	if ttl > 0 {
+		binary.BigEndian.PutUint64(payload[sessionIDSize:], uint64(time.Now().Add(ttl).Unix()))
+	}
 
-	buffer.WriteString(s.getStatelessPersistentSessionCookieName())
-	buffer.WriteString("=")
-	buffer.WriteString(endpoint.Signature)
+	key := s.keys[0]
+	if s.Encrypt {
+		nonce := make([]byte, key.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		return base64.RawURLEncoding.EncodeToString(key.aead.Seal(nonce, nonce, payload, nil)), nil
+	}
+
+	mac := hmac.New(sha256.New, key.mac)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(payload)[:sessionPayloadSize+sessionMacSize]), nil
+}
+
+// verifies the value against every configured key and returns the endpoint id
+func (s *StatelessSessionPersistence) decode(value string) ([]byte, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload []byte
+	for _, key := range s.keys {
+		if s.Encrypt {
+			nonceSize := key.aead.NonceSize()
+			if len(raw) < nonceSize {
+				break
+			}
+			if opened, err := key.aead.Open(nil, raw[:nonceSize], raw[nonceSize:], nil); err == nil {
+				payload = opened
+				break
+			}
+			continue
+		}
+
+		if len(raw) != sessionPayloadSize+sessionMacSize {
+			break
+		}
+		mac := hmac.New(sha256.New, key.mac)
+		mac.Write(raw[:sessionPayloadSize])
+		if hmac.Equal(mac.Sum(nil)[:sessionMacSize], raw[sessionPayloadSize:]) {
+			payload = raw[:sessionPayloadSize]
+			break
+		}
+	}
 
-	if group.Path != "" {
-		buffer.WriteString("; Path=")
-		buffer.WriteString(group.Path)
+	if len(payload) != sessionPayloadSize {
+		return nil, errors.New("persistent session cookie signature mismatch")
 	}
 
-	if len(s.CookieSettings) != 0 {
-		buffer.WriteString("; ")
-		buffer.WriteString(strings.Join(s.CookieSettings[:], "; "))
+	expiry := binary.BigEndian.Uint64(payload[sessionIDSize:])
+	if expiry != 0 && time.Now().Unix() > int64(expiry) {
+		return nil, errors.New("persistent session cookie expired")
 	}
 
-	w.Header().Add("Set-Cookie", buffer.String())
+	return payload[:sessionIDSize], nil
 }
 
-func (s StatelessSessionPersistence) get(r *http.Request, endpoints []*Endpoint) (*Endpoint, error) {
-	cookieval, e := s.getCookie(r)
+func (s *StatelessSessionPersistence) setCookie(w http.ResponseWriter, r *http.Request, cookie *sessionCookie, endpoint *Endpoint) {
+	value, err := s.encode(endpoint, cookie.ttl)
+	if err != nil {
+		slog.Error("error encoding persistent session cookie", "error", err)
+		return
+	}
+
+	http.SetCookie(w, cookie.build(r, value))
+}
+
+func (s *StatelessSessionPersistence) get(r *http.Request, cookie *sessionCookie, endpoints []*Endpoint) (*Endpoint, error) {
+	cookieval, e := s.getCookie(r, cookie.name)
+	if e != nil {
+		return nil, e
+	}
+
+	id, e := s.decode(cookieval)
 	if e != nil {
 		return nil, e
 	}
 
 	for _, endp := range endpoints {
-		if endp.Signature == cookieval {
+		if hmac.Equal(endp.sessionID, id) {
 			return endp, nil
 		}
 	}
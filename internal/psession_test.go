@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func startSessionPersistence(t *testing.T, s *StatelessSessionPersistence) *StatelessSessionPersistence {
+	t.Helper()
+	if err := s.Start(true); err != nil {
+		t.Fatalf("starting session persistence: %v", err)
+	}
+	return s
+}
+
+// hex encoded secret of the minimum size
+func sessionSecret(seed byte) string {
+	return hex.EncodeToString(bytes.Repeat([]byte{seed}, minSessionSecretSize))
+}
+
+func sessionEndpoint(address string) *Endpoint {
+	endpoint := &Endpoint{Address: address}
+	endpoint.sessionID = sessionID(endpoint, &Group{Path: "/"})
+	return endpoint
+}
+
+func TestSessionCookieRoundTrip(t *testing.T) {
+	endpoint := sessionEndpoint("http://a")
+
+	for _, encrypt := range []bool{false, true} {
+		s := startSessionPersistence(t, &StatelessSessionPersistence{Secrets: []string{sessionSecret(1)}, Encrypt: encrypt})
+
+		value, err := s.encode(endpoint, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := s.decode(value)
+		if err != nil {
+			t.Fatalf("encrypt %v: decoding a valid cookie: %v", encrypt, err)
+		}
+		if string(id) != string(endpoint.sessionID) {
+			t.Errorf("encrypt %v: decoded id %x, want %x", encrypt, id, endpoint.sessionID)
+		}
+	}
+}
+
+func TestSessionCookieEncryptionHidesEndpoint(t *testing.T) {
+	endpoint := sessionEndpoint("http://a")
+	s := startSessionPersistence(t, &StatelessSessionPersistence{Secrets: []string{sessionSecret(1)}, Encrypt: true})
+
+	first, _ := s.encode(endpoint, 0)
+	second, _ := s.encode(endpoint, 0)
+	if first == second {
+		t.Error("encrypted cookies of the same endpoint must differ")
+	}
+
+	raw, _ := base64.RawURLEncoding.DecodeString(first)
+	for i := 0; i+sessionIDSize <= len(raw); i++ {
+		if string(raw[i:i+sessionIDSize]) == string(endpoint.sessionID) {
+			t.Fatal("the endpoint id is visible in the encrypted cookie")
+		}
+	}
+}
+
+func TestSessionCookieTampering(t *testing.T) {
+	endpoint := sessionEndpoint("http://a")
+
+	for _, encrypt := range []bool{false, true} {
+		s := startSessionPersistence(t, &StatelessSessionPersistence{Secrets: []string{sessionSecret(1)}, Encrypt: encrypt})
+		value, _ := s.encode(endpoint, 0)
+		raw, _ := base64.RawURLEncoding.DecodeString(value)
+
+		for i := range raw {
+			tampered := append([]byte(nil), raw...)
+			tampered[i] ^= 0x01
+			if _, err := s.decode(base64.RawURLEncoding.EncodeToString(tampered)); err == nil {
+				t.Fatalf("encrypt %v: cookie with byte %d flipped accepted", encrypt, i)
+			}
+		}
+
+		for _, invalid := range []string{"", "!", base64.RawURLEncoding.EncodeToString(raw[:len(raw)-1])} {
+			if _, err := s.decode(invalid); err == nil {
+				t.Errorf("encrypt %v: invalid cookie %q accepted", encrypt, invalid)
+			}
+		}
+	}
+}
+
+func TestSessionCookieKeyRotation(t *testing.T) {
+	endpoint := sessionEndpoint("http://a")
+	old := startSessionPersistence(t, &StatelessSessionPersistence{Secrets: []string{sessionSecret(2)}})
+	value, _ := old.encode(endpoint, 0)
+
+	rotated := startSessionPersistence(t, &StatelessSessionPersistence{Secrets: []string{sessionSecret(3), sessionSecret(2)}})
+	if _, err := rotated.decode(value); err != nil {
+		t.Errorf("cookie signed with the previous key rejected: %v", err)
+	}
+	renewed, _ := rotated.encode(endpoint, 0)
+	if _, err := old.decode(renewed); err == nil {
+		t.Error("new cookies must be signed with the first key")
+	}
+
+	removed := startSessionPersistence(t, &StatelessSessionPersistence{Secrets: []string{sessionSecret(3)}})
+	if _, err := removed.decode(value); err == nil {
+		t.Error("cookie signed with a removed key accepted")
+	}
+}
+
+func TestSessionCookieExpiry(t *testing.T) {
+	endpoint := sessionEndpoint("http://a")
+	s := startSessionPersistence(t, &StatelessSessionPersistence{Secrets: []string{sessionSecret(1)}})
+
+	//cookie signed with the current key, expired a minute ago
+	payload := make([]byte, sessionPayloadSize)
+	copy(payload, endpoint.sessionID)
+	binary.BigEndian.PutUint64(payload[sessionIDSize:], uint64(time.Now().Add(-time.Minute).Unix()))
+	mac := hmac.New(sha256.New, s.keys[0].mac)
+	mac.Write(payload)
+	expired := base64.RawURLEncoding.EncodeToString(mac.Sum(payload)[:sessionPayloadSize+sessionMacSize])
+
+	if _, err := s.decode(expired); err == nil {
+		t.Error("expired cookie accepted")
+	}
+	forever, _ := s.encode(endpoint, 0)
+	if _, err := s.decode(forever); err != nil {
+		t.Errorf("cookie without expiry rejected: %v", err)
+	}
+}
+
+func TestSessionPersistenceSecrets(t *testing.T) {
+	short := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, minSessionSecretSize-1))
+	for _, secrets := range [][]string{{""}, {"change-me"}, {"0123456789abcdef"}, {short}, {sessionSecret(1), "CHANGEME"}} {
+		s := &StatelessSessionPersistence{Secrets: secrets}
+		if err := s.Start(true); err == nil {
+			t.Errorf("secrets %q accepted", secrets)
+		}
+	}
+
+	//the same bytes encoded in hex or base64 are the same key
+	endpoint := sessionEndpoint("http://a")
+	hexEncoded := startSessionPersistence(t, &StatelessSessionPersistence{Secrets: []string{sessionSecret(1)}})
+	base64Encoded := startSessionPersistence(t, &StatelessSessionPersistence{
+		Secrets: []string{base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, minSessionSecretSize))},
+	})
+	value, _ := hexEncoded.encode(endpoint, 0)
+	if _, err := base64Encoded.decode(value); err != nil {
+		t.Errorf("cookie signed with the hex secret rejected with the base64 one: %v", err)
+	}
+
+	//without secrets a random key is generated, different for every instance
+	first := startSessionPersistence(t, &StatelessSessionPersistence{})
+	second := startSessionPersistence(t, &StatelessSessionPersistence{})
+	value, _ = first.encode(endpoint, 0)
+	if _, err := second.decode(value); err == nil {
+		t.Error("generated keys of two instances must differ")
+	}
+}
+
+func TestSessionPersistenceGet(t *testing.T) {
+	a, b := sessionEndpoint("http://a"), sessionEndpoint("http://b")
+	s := startSessionPersistence(t, &StatelessSessionPersistence{Secrets: []string{sessionSecret(1)}})
+	cookie := &sessionCookie{name: "sticky", path: "/"}
+
+	w := httptest.NewRecorder()
+	s.setCookie(w, httptest.NewRequest(http.MethodGet, "/", nil), cookie, b)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	if got, err := s.get(r, cookie, []*Endpoint{a, b}); err != nil || got != b {
+		t.Errorf("get = %v, %v, want the endpoint of the cookie", got, err)
+	}
+	if _, err := s.get(r, cookie, []*Endpoint{a}); err == nil {
+		t.Error("cookie of an endpoint not in the group accepted")
+	}
+	if _, err := s.get(httptest.NewRequest(http.MethodGet, "/", nil), cookie, []*Endpoint{a, b}); err == nil {
+		t.Error("request without cookie matched an endpoint")
+	}
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"math/rand/v2"
+	"net/http"
+
+	"minibalancer/balancer"
+)
+
+type random struct {
+}
+
+// random choice proportional to the effective weight
+func (random *random) Balance(_ *http.Request, endpoints []balancer.Endpoint) (balancer.Endpoint, error) {
+	var total float64
+	for _, e := range endpoints {
+		total += e.EffectiveWeight()
+	}
+
+	//every endpoint has weight 0
+	if total <= 0 {
+		return endpoints[rand.IntN(len(endpoints))], nil
+	}
+
+	pick := rand.Float64() * total
+	for _, e := range endpoints {
+		pick -= e.EffectiveWeight()
+		if pick < 0 {
+			return e, nil
+		}
+	}
+
+	//rounding, or weights changed while picking
+	return endpoints[len(endpoints)-1], nil
+}
+
+type powerOfTwoChoices struct {
+}
+
+// two random endpoints, the one with fewer active connections per unit of weight wins
+func (p2c *powerOfTwoChoices) Balance(_ *http.Request, endpoints []balancer.Endpoint) (balancer.Endpoint, error) {
+	a, b := pickTwo(endpoints)
+	if b == nil {
+		return a, nil
+	}
+
+	loadA := weightedLoad(float64(a.InFlight()), a.EffectiveWeight())
+	loadB := weightedLoad(float64(b.InFlight()), b.EffectiveWeight())
+	if loadA <= loadB {
+		return a, nil
+	}
+	return b, nil
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"testing"
+
+	"minibalancer/balancer"
+)
+
+func weightedEndpoint(address string, weight int) *Endpoint {
+	endpoint := &Endpoint{Address: address, Weight: &weight}
+	endpoint.Alive.Store(true)
+	return endpoint
+}
+
+func TestRandomWeights(t *testing.T) {
+	light, heavy := weightedEndpoint("light", 1), weightedEndpoint("heavy", 3)
+	endpoints := []balancer.Endpoint{light, heavy}
+
+	const picks = 10000
+	counts := make(map[balancer.Endpoint]int)
+	for range picks {
+		chosen, err := (&random{}).Balance(nil, endpoints)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[chosen]++
+	}
+
+	//a quarter of the picks expected, far outside any plausible deviation
+	if share := float64(counts[light]) / picks; share < 0.2 || share > 0.3 {
+		t.Errorf("light endpoint share %.2f, want 0.25", share)
+	}
+}
+
+func TestPowerOfTwoChoices(t *testing.T) {
+	idle, busy := weightedEndpoint("idle", 1), weightedEndpoint("busy", 1)
+	busy.ActiveConnections.Store(5)
+
+	for range 100 {
+		chosen, err := (&powerOfTwoChoices{}).Balance(nil, []balancer.Endpoint{busy, idle})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chosen != idle {
+			t.Fatal("busy endpoint chosen")
+		}
+	}
+
+	//the load is per unit of weight
+	heavy := weightedEndpoint("heavy", 10)
+	heavy.ActiveConnections.Store(5)
+	idle.ActiveConnections.Store(1)
+	if chosen, _ := (&powerOfTwoChoices{}).Balance(nil, []balancer.Endpoint{idle, heavy}); chosen != heavy {
+		t.Error("weight ignored by p2c")
+	}
+
+	//every other endpoint is seen over enough picks
+	endpoints := []balancer.Endpoint{weightedEndpoint("a", 1), weightedEndpoint("b", 1), weightedEndpoint("c", 1)}
+	seen := make(map[balancer.Endpoint]bool)
+	for range 300 {
+		chosen, _ := (&powerOfTwoChoices{}).Balance(nil, endpoints)
+		seen[chosen] = true
+	}
+	if len(seen) != len(endpoints) {
+		t.Errorf("%d endpoints chosen out of %d", len(seen), len(endpoints))
+	}
+}
+
+func TestUnknownAlgorithm(t *testing.T) {
+	for _, name := range []string{"", "RANDOM", "p2c", "peakewma", "failover"} {
+		if err := (&Group{Algorithm: name}).initBalancing(); err != nil {
+			t.Errorf("algorithm %q rejected: %v", name, err)
+		}
+	}
+	if err := (&Group{Algorithm: "fastest"}).initBalancing(); err == nil {
+		t.Error("unknown algorithm accepted")
+	}
+}
@@ -1,56 +1,32 @@
 package internal
 
 import (
-	"errors"
+	"net/http"
 	"sync/atomic"
+
+	"minibalancer/balancer"
 )
 
+// upper bound of full rounds over the endpoints before giving up
+const maxRoundRobinRounds = 16
+
 type roundRobin struct {
 	endpointIndex atomic.Uint32
 }
 
-func (roundRobin *roundRobin) balanced(endpoints []*Endpoint, retriedIndexesF any) (*Endpoint, error) {
-	if retriedIndexesF == nil {
-		retriedIndexesF = []uint32{}
-	}
-	retriedIndexes := retriedIndexesF.([]uint32)
-
-	oldIndex := roundRobin.endpointIndex.Load()
-	choosenEndp := endpoints[oldIndex]
-	endpointsLen := len(endpoints)
-	//if reached enpoints length restart from 0
-	var newIndex uint32 = 0
-	if oldIndex < uint32(endpointsLen)-1 {
-		newIndex = oldIndex + 1
-	}
-
-	if choosenEndp.Alive.Load() {
-
-		if roundRobin.endpointIndex.CompareAndSwap(oldIndex, newIndex) {
-			return endpoints[oldIndex], nil
-		}
-
-		return roundRobin.balanced(endpoints, nil)
-	}
-
-	//trying to swap index if it is not already swapped, this index is not alive
-	roundRobin.endpointIndex.CompareAndSwap(oldIndex, newIndex)
-
-	if len(retriedIndexes) == endpointsLen {
-		return nil, errors.New("all endpoints down")
-	}
-
-	found := false
-	for _, retryIndex := range retriedIndexes {
-		if retryIndex == oldIndex {
-			found = true
-			break
+// every endpoint is visited in turn and accepted with a probability proportional to its
+// effective weight, so the share of requests follows weights and slow start without locking
+func (roundRobin *roundRobin) Balance(_ *http.Request, endpoints []balancer.Endpoint) (balancer.Endpoint, error) {
+	maxWeight := maxEffectiveWeight(endpoints)
+	endpointsLen := uint32(len(endpoints))
+	for range endpointsLen * maxRoundRobinRounds {
+		index := roundRobin.endpointIndex.Add(1) - 1
+		choosenEndp := endpoints[index%endpointsLen]
+
+		if acceptWeighted(choosenEndp, maxWeight) {
+			return choosenEndp, nil
 		}
 	}
 
-	if !found {
-		retriedIndexes = append(retriedIndexes, oldIndex)
-	}
-
-	return roundRobin.balanced(endpoints, retriedIndexes)
+	return nil, balancer.ErrNoEndpoint
 }
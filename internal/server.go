@@ -0,0 +1,300 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	PROTO_H1  = "h1"
+	PROTO_H2  = "h2"
+	PROTO_H3  = "h3"
+	PROTO_H2C = "h2c"
+	//raw connections, see proxyRaw
+	PROTO_TCP = "tcp"
+	//datagrams, see udpServer
+	PROTO_UDP = "udp"
+)
+
+// protocols served by the bind, when protocols is not set the legacy protocol field is mapped:
+// HTTP/3 serves h1, h2 and h3, HTTP/2 h1 and h2, anything else h1 (and h2 when ssl is set).
+// h1 is always served by the TCP listener, even when only h2 or h2c is requested.
+// tcp and udp cannot be mixed with any other protocol
+func (bind *Bind) protocolSet() (map[string]bool, error) {
+	names := bind.Protocols
+	if len(names) == 0 {
+		switch strings.ToUpper(bind.Protocol) {
+		case "HTTP/3":
+			names = []string{PROTO_H1, PROTO_H2, PROTO_H3}
+		case "HTTP/2":
+			names = []string{PROTO_H1, PROTO_H2}
+		case "TCP":
+			names = []string{PROTO_TCP}
+		case "UDP":
+			names = []string{PROTO_UDP}
+		default:
+			names = []string{PROTO_H1}
+			if len(bind.SSL) != 0 {
+				names = append(names, PROTO_H2)
+			}
+		}
+	}
+
+	protocols := make(map[string]bool, len(names))
+	for _, name := range names {
+		switch protocol := strings.ToLower(name); protocol {
+		case PROTO_H1, PROTO_H2, PROTO_H3, PROTO_H2C, PROTO_TCP, PROTO_UDP:
+			protocols[protocol] = true
+		default:
+			return nil, fmt.Errorf("unknown protocol %q", name)
+		}
+	}
+
+	for _, network := range []string{PROTO_TCP, PROTO_UDP} {
+		if !protocols[network] {
+			continue
+		}
+		if len(protocols) != 1 {
+			return nil, fmt.Errorf("%s binds cannot serve other protocols", network)
+		}
+		if len(bind.SSL) != 0 {
+			return nil, fmt.Errorf("%s binds do not terminate TLS, remove the SSL certificates", network)
+		}
+		return protocols, nil
+	}
+
+	for _, protocol := range []string{PROTO_H2, PROTO_H3} {
+		if protocols[protocol] && len(bind.SSL) == 0 {
+			return nil, fmt.Errorf("cannot start %s without SSL certificate", protocol)
+		}
+	}
+	if protocols[PROTO_H2C] && len(bind.SSL) != 0 {
+		return nil, errors.New("h2c is cleartext HTTP/2, it cannot be served with SSL certificates")
+	}
+	return protocols, nil
+}
+
+// owns the listeners of a bind, they are opened synchronously so that start errors
+// reach the caller. A failing TCP server takes the whole bind down, a failing QUIC
+// server only stops the HTTP/3 advertisement
+type supervisor struct {
+	tcp       net.Listener
+	udp       net.PacketConn
+	transport *quic.Transport
+	quic      *quic.EarlyListener
+	//Alt-Svc is advertised only while the QUIC listener accepts connections
+	quicUp    atomic.Bool
+	stopping  atomic.Bool
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (bind *Bind) startServers(tlsConfig *tls.Config, protocols map[string]bool) error {
+	sup := &supervisor{}
+
+	handler := http.Handler(http.HandlerFunc(bind.reverseproxyHandler))
+	if protocols[PROTO_H3] {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if sup.quicUp.Load() {
+				bind.Http3Server.SetQUICHeaders(w.Header())
+			}
+			bind.reverseproxyHandler(w, r)
+		})
+	}
+
+	//prior knowledge and Upgrade: h2c, anything else falls through to HTTP/1.1
+	if protocols[PROTO_H2C] {
+		handler = h2c.NewHandler(handler, &http2.Server{
+			IdleTimeout: getWithDefaultDuration(bind.IdleTimeout, DefaultIdleTimeout),
+		})
+	}
+
+	if protocols[PROTO_H1] || protocols[PROTO_H2] || protocols[PROTO_H2C] {
+		//a non nil empty map keeps net/http from enabling h2 on its own
+		var tlsNextProto map[string]func(*http.Server, *tls.Conn, http.Handler)
+		if !protocols[PROTO_H2] || bind.TLS.disablesHTTP2() {
+			tlsNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+
+		ln, err := net.Listen("tcp", bind.Address)
+		if err != nil {
+			return err
+		}
+		if bind.hasPassthrough() {
+			ln = bind.newPassthroughListener(ln)
+		}
+		sup.tcp = ln
+
+		bind.Http12Server =
+			&http.Server{
+				Addr:              bind.Address,
+				TLSNextProto:      tlsNextProto,
+				TLSConfig:         tlsConfig,
+				ReadTimeout:       getWithDefaultDuration(bind.ReadTimeout, DefaultReadTimeout),
+				ReadHeaderTimeout: getWithDefaultDuration(bind.ReadHeaderTimeout, DefaultReadHeaderTimeout),
+				WriteTimeout:      getWithDefaultDuration(bind.WriteTimeout, DefaultWriteTimeout),
+				IdleTimeout:       getWithDefaultDuration(bind.IdleTimeout, DefaultIdleTimeout),
+				MaxHeaderBytes:    getWithDefaultInt(bind.MaxHeaderBytes, DefaultMaxHeaderBytes),
+				Handler:           handler,
+			}
+	}
+
+	if protocols[PROTO_H3] {
+		udp, err := net.ListenPacket("udp", bind.Address)
+		if err != nil {
+			sup.closeListeners()
+			return err
+		}
+		sup.udp = udp
+
+		//the listener is owned by the transport, closing it stops new connections only
+		quicConfig := &quic.Config{Allow0RTT: true}
+		sup.transport = &quic.Transport{Conn: udp}
+		sup.quic, err = sup.transport.ListenEarly(http3.ConfigureTLSConfig(tlsConfig.Clone()), quicConfig)
+		if err != nil {
+			sup.closeListeners()
+			return err
+		}
+
+		bind.Http3Server = &http3.Server{
+			Addr:           bind.Address,
+			IdleTimeout:    getWithDefaultDuration(bind.IdleTimeout, DefaultIdleTimeout),
+			MaxHeaderBytes: getWithDefaultInt(bind.MaxHeaderBytes, DefaultMaxHeaderBytes),
+			QUICConfig:     quicConfig,
+			Handler:        handler,
+		}
+	}
+
+	bind.servers = sup
+
+	if sup.tcp != nil {
+		sup.wg.Add(1)
+		go func() {
+			defer sup.wg.Done()
+
+			var err error
+			if tlsConfig == nil {
+				err = bind.Http12Server.Serve(sup.tcp)
+			} else {
+				err = bind.Http12Server.ServeTLS(sup.tcp, "", "")
+			}
+			if sup.stopping.Load() || errors.Is(err, http.ErrServerClosed) {
+				return
+			}
+
+			slog.Error("bind server failed, closing the bind", "bind", bind.Address, "error", err)
+			if sup.quic != nil {
+				sup.quicUp.Store(false)
+				bind.Http3Server.Close()
+				sup.closeQUIC()
+			}
+		}()
+	}
+
+	if sup.quic != nil {
+		sup.quicUp.Store(true)
+		sup.wg.Add(1)
+		go func() {
+			defer sup.wg.Done()
+
+			err := bind.Http3Server.ServeListener(sup.quic)
+			sup.quicUp.Store(false)
+			if sup.stopping.Load() || errors.Is(err, http.ErrServerClosed) {
+				return
+			}
+
+			slog.Error("HTTP/3 server failed, Alt-Svc no longer advertised", "bind", bind.Address, "error", err)
+			sup.closeQUIC()
+		}()
+	}
+
+	return nil
+}
+
+// h2c upgrades are handled by the listener, an upgrade header reaching the reverse proxy
+// would be forwarded to the endpoint which may switch protocol on its own
+func stripH2CUpgrade(r *http.Request) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "h2c") {
+		return
+	}
+	r.Header.Del("Upgrade")
+	r.Header.Del("Http2-Settings")
+	r.Header.Del("Connection")
+}
+
+// used when the start fails halfway
+func (sup *supervisor) closeListeners() {
+	if sup.tcp != nil {
+		sup.tcp.Close()
+	}
+	if sup.udp != nil {
+		sup.closeQUIC()
+	}
+}
+
+// the transport does not close a socket it did not create, called by both the
+// failing server and Stop
+func (sup *supervisor) closeQUIC() error {
+	sup.closeOnce.Do(func() {
+		if sup.transport != nil {
+			sup.closeErr = sup.transport.Close()
+		}
+		sup.closeErr = errors.Join(sup.closeErr, sup.udp.Close())
+	})
+	return sup.closeErr
+}
+
+// new QUIC connections are refused while the TCP server drains, quic-go has no graceful
+// close yet so the remaining HTTP/3 requests are aborted once the TCP side is done
+func (bind *Bind) stopServers(ctx context.Context) error {
+	sup := bind.servers
+	if sup == nil {
+		return nil
+	}
+	bind.servers = nil
+	sup.stopping.Store(true)
+	sup.quicUp.Store(false)
+
+	var errs []error
+	if sup.quic != nil {
+		errs = append(errs, sup.quic.Close())
+	}
+
+	if bind.Http12Server != nil {
+		errs = append(errs, bind.Http12Server.Shutdown(ctx))
+	}
+
+	if bind.Http3Server != nil {
+		errs = append(errs, bind.Http3Server.Close())
+		//closes the connections left and the UDP socket
+		errs = append(errs, sup.closeQUIC())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		sup.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, ctx.Err())
+	}
+
+	return errors.Join(errs...)
+}
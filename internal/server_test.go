@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// starts the configuration, binds listen on 127.0.0.1:0 and are stopped with the test
+func startTestConf(t *testing.T, config string) *Conf {
+	t.Helper()
+	conf, err := ParseConf([]byte(config), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.Start(); err != nil {
+		conf.Stop(context.Background())
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conf.Stop(context.Background()) })
+	return conf
+}
+
+// configuration of a single bind proxying every path to endpoint, bind and group are
+// JSON fields added to the bind and to its group
+func testBindConf(bind string, group string, endpoint string) string {
+	return fmt.Sprintf(`{"settings": {"bindings": [{"address": "127.0.0.1:0", %s
+		"groups": [{"path": "/", %s "endpoints": [{"address": %q}]}]}]}}`, bind, group, endpoint)
+}
+
+// address of the TCP listener of the bind
+func (bind *Bind) listenAddr() string {
+	return bind.servers.tcp.Addr().String()
+}
+
+func TestProtocolSet(t *testing.T) {
+	ssl := []*SSL{{CertFilePath: "server.crt", KeyFilePath: "server.key"}}
+
+	tests := []struct {
+		name string
+		bind *Bind
+		want []string
+	}{
+		{"default", &Bind{}, []string{PROTO_H1}},
+		{"default with ssl", &Bind{SSL: ssl}, []string{PROTO_H1, PROTO_H2}},
+		{"legacy HTTP/3", &Bind{Protocol: "http/3", SSL: ssl}, []string{PROTO_H1, PROTO_H2, PROTO_H3}},
+		{"legacy HTTP/2", &Bind{Protocol: "HTTP/2", SSL: ssl}, []string{PROTO_H1, PROTO_H2}},
+		{"explicit list", &Bind{Protocols: []string{"H1", "h2c"}}, []string{PROTO_H1, PROTO_H2C}},
+		{"h3 only", &Bind{Protocols: []string{"h3"}, SSL: ssl}, []string{PROTO_H3}},
+	}
+	for _, test := range tests {
+		protocols, err := test.bind.protocolSet()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		want := make(map[string]bool)
+		for _, protocol := range test.want {
+			want[protocol] = true
+		}
+		if !maps.Equal(protocols, want) {
+			t.Errorf("%s: protocols %v, want %v", test.name, protocols, test.want)
+		}
+	}
+
+	invalid := map[string]*Bind{
+		"unknown protocol": {Protocols: []string{"spdy"}},
+		"h2 without ssl":   {Protocols: []string{"h2"}},
+		"h3 without ssl":   {Protocols: []string{"h3"}},
+		"h2c with ssl":     {Protocols: []string{"h2c"}, SSL: ssl},
+	}
+	for name, bind := range invalid {
+		if _, err := bind.protocolSet(); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestBindStopReleasesAddress(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	conf, err := ParseConf([]byte(testBindConf("", "", backend.URL)), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.Start(); err != nil {
+		t.Fatal(err)
+	}
+	address := conf.Settings.Bind[0].listenAddr()
+
+	resp, err := http.Get("http://" + address + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("body = %q", body)
+	}
+
+	if err := conf.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("address still in use after Stop: %v", err)
+	}
+	ln.Close()
+}
+
+// endpoint answering with the protocol and the Upgrade header it received
+func protocolEcho(t *testing.T) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upgrade", r.Header.Get("Upgrade"))
+		fmt.Fprint(w, r.Proto)
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestH2CPriorKnowledge(t *testing.T) {
+	backend := protocolEcho(t)
+	conf := startTestConf(t, testBindConf(`"protocols": ["h1", "h2c"],`, "", backend.URL))
+	address := conf.Settings.Bind[0].listenAddr()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}}
+	resp, err := client.Get("http://" + address + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("response over %s, want HTTP/2", resp.Proto)
+	}
+
+	//HTTP/1.1 keeps working on the same listener
+	resp, err = http.Get("http://" + address + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 1 || resp.StatusCode != http.StatusOK {
+		t.Errorf("HTTP/1.1 request answered %s over %s", resp.Status, resp.Proto)
+	}
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	backend := protocolEcho(t)
+	conf := startTestConf(t, testBindConf(`"protocols": ["h1", "h2c"],`, "", backend.URL))
+
+	conn, err := net.Dial("tcp", conf.Settings.Bind[0].listenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	//empty SETTINGS payload
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: test\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || !strings.EqualFold(resp.Header.Get("Upgrade"), "h2c") {
+		t.Errorf("upgrade answered %s, Upgrade %q", resp.Status, resp.Header.Get("Upgrade"))
+	}
+}
+
+func TestH2CUpgradeNotForwarded(t *testing.T) {
+	backend := protocolEcho(t)
+	conf := startTestConf(t, testBindConf("", "", backend.URL))
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+conf.Settings.Bind[0].listenAddr()+"/", nil)
+	req.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+	req.Header.Set("Upgrade", "h2c")
+	req.Header.Set("HTTP2-Settings", "")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Upgrade") != "" {
+		t.Errorf("answered %s, endpoint received Upgrade %q", resp.Status, resp.Header.Get("X-Upgrade"))
+	}
+}
+
+func TestH2CUpstream(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}), &http2.Server{}))
+	defer backend.Close()
+
+	config := fmt.Sprintf(`{"settings": {"bindings": [{"address": "127.0.0.1:0",
+		"groups": [{"path": "/", "endpoints": [{"address": %q, "upstreamProtocol": "h2c"}]}]}]}}`, backend.URL)
+	conf := startTestConf(t, config)
+
+	resp, err := http.Get("http://" + conf.Settings.Bind[0].listenAddr() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "HTTP/2.0" {
+		t.Errorf("endpoint reached over %q, want HTTP/2.0", body)
+	}
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// typed attributes of the session persistence cookie of a group, unset fields
+// fall back to the global sessionPersistenceDetails
+type SessionCookie struct {
+	Name   string `json:"name,omitempty"`
+	TTL    string `json:"ttl,omitempty"`
+	Domain string `json:"domain,omitempty"`
+	//defaults to the group path
+	Path string `json:"path,omitempty"`
+	//defaults to true when the request is received over TLS
+	Secure *bool `json:"secure,omitempty"`
+	//defaults to false, as before typed attributes, unless the legacy cookieSettings set it
+	HttpOnly *bool `json:"httpOnly,omitempty"`
+	//lax, strict or none
+	SameSite string `json:"sameSite,omitempty"`
+}
+
+// resolved cookie of a group, built at start so that requests only fill the value
+type sessionCookie struct {
+	name     string
+	ttl      time.Duration
+	domain   string
+	path     string
+	secure   *bool
+	httpOnly bool
+	sameSite http.SameSite
+}
+
+// legacy free form cookieSettings, e.g. ["HttpOnly", "SameSite=Strict"], mapped to typed attributes
+func parseCookieSettings(settings []string) SessionCookie {
+	var parsed SessionCookie
+	for _, setting := range settings {
+		key, value, _ := strings.Cut(strings.TrimSpace(setting), "=")
+		switch strings.ToLower(key) {
+		case "httponly":
+			httpOnly := true
+			parsed.HttpOnly = &httpOnly
+		case "secure":
+			secure := true
+			parsed.Secure = &secure
+		case "samesite":
+			parsed.SameSite = value
+		case "domain":
+			parsed.Domain = value
+		case "path":
+			parsed.Path = value
+		case "max-age":
+			//seconds
+			parsed.TTL = value + "s"
+		default:
+			slog.Warn("ignoring unknown cookie setting", "setting", setting)
+		}
+	}
+	return parsed
+}
+
+func parseSameSite(sameSite string) (http.SameSite, error) {
+	switch strings.ToLower(sameSite) {
+	case "":
+		return http.SameSiteDefaultMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return http.SameSiteDefaultMode, fmt.Errorf("invalid cookie SameSite %q", sameSite)
+}
+
+// group attributes have precedence over the global ones
+func newSessionCookie(group *Group, global *StatelessSessionPersistence) (*sessionCookie, error) {
+	legacy := parseCookieSettings(global.CookieSettings)
+
+	var typed SessionCookie
+	if group.Stickiness != nil && group.Stickiness.Cookie != nil {
+		typed = *group.Stickiness.Cookie
+	}
+
+	cookie := &sessionCookie{
+		name:   firstNonEmpty(typed.Name, global.CookieName, "_gbsps"),
+		ttl:    getWithDefaultDuration(firstNonEmpty(typed.TTL, global.TTL, legacy.TTL), 0),
+		domain: firstNonEmpty(typed.Domain, legacy.Domain),
+		path:   firstNonEmpty(typed.Path, legacy.Path, group.Path),
+		secure: typed.Secure,
+	}
+
+	if cookie.secure == nil {
+		cookie.secure = legacy.Secure
+	}
+
+	switch {
+	case typed.HttpOnly != nil:
+		cookie.httpOnly = *typed.HttpOnly
+	case legacy.HttpOnly != nil:
+		cookie.httpOnly = *legacy.HttpOnly
+	}
+
+	sameSite, err := parseSameSite(firstNonEmpty(typed.SameSite, legacy.SameSite))
+	if err != nil {
+		return nil, err
+	}
+	cookie.sameSite = sameSite
+
+	if cookie.sameSite == http.SameSiteNoneMode && cookie.secure != nil && !*cookie.secure {
+		return nil, fmt.Errorf("cookie %s with SameSite=None must be secure", cookie.name)
+	}
+
+	//validating name, domain and path once, the value is always base64url
+	if err := cookie.build(nil, "probe").Valid(); err != nil {
+		return nil, err
+	}
+
+	return cookie, nil
+}
+
+func (cookie *sessionCookie) build(r *http.Request, value string) *http.Cookie {
+	secure := r != nil && r.TLS != nil
+	if cookie.secure != nil {
+		secure = *cookie.secure
+	}
+
+	c := &http.Cookie{
+		Name:     cookie.name,
+		Value:    value,
+		Domain:   cookie.domain,
+		Path:     cookie.path,
+		Secure:   secure || cookie.sameSite == http.SameSiteNoneMode,
+		HttpOnly: cookie.httpOnly,
+		SameSite: cookie.sameSite,
+	}
+
+	if cookie.ttl > 0 {
+		c.MaxAge = int(cookie.ttl.Seconds())
+	}
+	return c
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
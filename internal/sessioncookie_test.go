@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseCookieSettings(t *testing.T) {
+	parsed := parseCookieSettings([]string{" HttpOnly", "secure", "SameSite=Strict", "Domain=example.com", "Path=/app", "Max-Age=60", "Partitioned"})
+
+	if parsed.HttpOnly == nil || !*parsed.HttpOnly || parsed.Secure == nil || !*parsed.Secure {
+		t.Errorf("flags not parsed: %+v", parsed)
+	}
+	if parsed.SameSite != "Strict" || parsed.Domain != "example.com" || parsed.Path != "/app" || parsed.TTL != "60s" {
+		t.Errorf("attributes not parsed: %+v", parsed)
+	}
+}
+
+func TestNewSessionCookie(t *testing.T) {
+	global := &StatelessSessionPersistence{CookieName: "lb", CookieSettings: []string{"SameSite=Lax", "Domain=example.com", "Max-Age=60"}}
+	httpOnly := false
+	group := &Group{Path: "/api", Stickiness: &Stickiness{Cookie: &SessionCookie{SameSite: "strict", HttpOnly: &httpOnly}}}
+
+	cookie, err := newSessionCookie(group, global)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := cookie.build(httptest.NewRequest(http.MethodGet, "/api", nil), "v")
+	if plain.Name != "lb" || plain.Path != "/api" || plain.Domain != "example.com" || plain.MaxAge != 60 {
+		t.Errorf("cookie = %+v", plain)
+	}
+	if plain.SameSite != http.SameSiteStrictMode || plain.HttpOnly || plain.Secure {
+		t.Errorf("group attributes not applied: %+v", plain)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api", nil)
+	r.TLS = &tls.ConnectionState{}
+	if !cookie.build(r, "v").Secure {
+		t.Error("cookie of a TLS request not secure")
+	}
+
+	defaults, err := newSessionCookie(&Group{Path: "/"}, &StatelessSessionPersistence{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := defaults.build(nil, "v"); c.Name != "_gbsps" || c.Path != "/" || c.HttpOnly || c.MaxAge != 0 {
+		t.Errorf("default cookie = %+v", c)
+	}
+
+	//HttpOnly stays opt-in, as with the legacy cookieSettings
+	legacy, err := newSessionCookie(&Group{Path: "/"}, &StatelessSessionPersistence{CookieSettings: []string{"HttpOnly"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !legacy.build(nil, "v").HttpOnly {
+		t.Error("legacy HttpOnly setting not applied")
+	}
+}
+
+func TestNewSessionCookieErrors(t *testing.T) {
+	secure := false
+	tests := map[string]*SessionCookie{
+		"unknown SameSite":       {SameSite: "sometimes"},
+		"insecure SameSite=None": {SameSite: "None", Secure: &secure},
+		"invalid name":           {Name: "a b"},
+	}
+	for name, typed := range tests {
+		group := &Group{Path: "/", Stickiness: &Stickiness{Cookie: typed}}
+		if _, err := newSessionCookie(group, &StatelessSessionPersistence{}); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+
+	cookie, err := newSessionCookie(&Group{Path: "/", Stickiness: &Stickiness{Cookie: &SessionCookie{SameSite: "none"}}}, &StatelessSessionPersistence{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cookie.build(nil, "v").Secure {
+		t.Error("SameSite=None cookie not secure")
+	}
+}
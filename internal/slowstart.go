@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+
+	"minibalancer/balancer"
+)
+
+// weight of a recovered endpoint at the beginning of the slow start window,
+// as a fraction of its full weight
+const slowStartMinFactor = 0.1
+
+// stores the health of the endpoint, an endpoint becoming alive starts its slow start
+// window, including on its first health check so that endpoints added to a running
+// group ramp up too. Endpoints starting together ramp together, their shares do not change
+func (endpoint *Endpoint) setAlive(alive bool) {
+	wasAlive := endpoint.Alive.Swap(alive)
+	if alive && !wasAlive {
+		endpoint.aliveSince.Store(time.Now().UnixNano())
+	}
+}
+
+// configured weight (default 1 when not set) scaled linearly during the slow start window
+func (endpoint *Endpoint) EffectiveWeight() float64 {
+	weight := 1.0
+	if endpoint.Weight != nil {
+		weight = float64(max(*endpoint.Weight, 0))
+	}
+
+	since := endpoint.aliveSince.Load()
+	if endpoint.slowStart <= 0 || since == 0 {
+		return weight
+	}
+
+	elapsed := time.Since(time.Unix(0, since))
+	if elapsed >= endpoint.slowStart {
+		return weight
+	}
+
+	factor := slowStartMinFactor + (1-slowStartMinFactor)*float64(elapsed)/float64(endpoint.slowStart)
+	return weight * factor
+}
+
+func maxEffectiveWeight(endpoints []balancer.Endpoint) float64 {
+	var maxWeight float64
+	for _, e := range endpoints {
+		maxWeight = max(maxWeight, e.EffectiveWeight())
+	}
+	return maxWeight
+}
+
+// load per unit of weight, an endpoint with weight 0 is always the most loaded
+func weightedLoad(load float64, weight float64) float64 {
+	if weight <= 0 {
+		return math.Inf(1)
+	}
+	return load / weight
+}
+
+// accepts the endpoint with a probability proportional to its effective weight
+func acceptWeighted(endpoint balancer.Endpoint, maxWeight float64) bool {
+	weight := endpoint.EffectiveWeight()
+	return weight >= maxWeight || rand.Float64()*maxWeight < weight
+}
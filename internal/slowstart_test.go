@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"minibalancer/balancer"
+)
+
+func TestEffectiveWeight(t *testing.T) {
+	tests := []struct {
+		name   string
+		weight *int
+		want   float64
+	}{
+		{"not set", nil, 1},
+		{"set", ptr(3), 3},
+		{"zero", ptr(0), 0},
+		{"negative", ptr(-2), 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			endpoint := &Endpoint{Weight: test.weight}
+			if got := endpoint.EffectiveWeight(); got != test.want {
+				t.Errorf("EffectiveWeight() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSlowStartRamp(t *testing.T) {
+	endpoint := &Endpoint{Weight: ptr(10), slowStart: time.Minute}
+
+	//first health check of an endpoint added to a running group
+	endpoint.setAlive(true)
+	if got := endpoint.EffectiveWeight(); got < 10*slowStartMinFactor || got > 10*slowStartMinFactor+0.1 {
+		t.Errorf("weight at the beginning of the window = %v, want about %v", got, 10*slowStartMinFactor)
+	}
+
+	endpoint.aliveSince.Store(time.Now().Add(-30 * time.Second).UnixNano())
+	if got := endpoint.EffectiveWeight(); got < 5 || got > 6 {
+		t.Errorf("weight halfway through the window = %v, want about 5.5", got)
+	}
+
+	endpoint.aliveSince.Store(time.Now().Add(-time.Minute).UnixNano())
+	if got := endpoint.EffectiveWeight(); got != 10 {
+		t.Errorf("weight after the window = %v, want 10", got)
+	}
+
+	//staying alive does not restart the window
+	endpoint.setAlive(true)
+	if got := endpoint.EffectiveWeight(); got != 10 {
+		t.Errorf("a health check of an alive endpoint restarted the window, weight %v", got)
+	}
+
+	endpoint.setAlive(false)
+	endpoint.setAlive(true)
+	if got := endpoint.EffectiveWeight(); got >= 10*slowStartMinFactor+0.1 {
+		t.Errorf("a recovered endpoint must restart the window, weight %v", got)
+	}
+}
+
+func TestZeroWeightNotChosen(t *testing.T) {
+	zero := &Endpoint{Address: "zero", Weight: ptr(0)}
+	one := &Endpoint{Address: "one"}
+	endpoints := []balancer.Endpoint{zero, one}
+
+	for _, name := range []string{ROUND_ROBIN, RANDOM, P2C} {
+		b, err := balancer.New(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range 200 {
+			chosen, err := b.Balance(nil, endpoints)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if chosen == zero {
+				t.Fatalf("%s chose the endpoint with weight 0", name)
+			}
+		}
+	}
+
+	//every weight is 0, the endpoints are still served
+	for _, name := range []string{ROUND_ROBIN, RANDOM, P2C} {
+		b, _ := balancer.New(name)
+		if chosen, err := b.Balance(nil, []balancer.Endpoint{zero, &Endpoint{Weight: ptr(0)}}); err != nil || chosen == nil {
+			t.Errorf("%s: no endpoint when every weight is 0: %v", name, err)
+		}
+	}
+}
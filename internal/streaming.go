@@ -0,0 +1,18 @@
+package internal
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// a streaming group (Server-Sent Events, long polling, chunked feeds) flushes every write
+// to the client and is not cut by the bind write timeout. The client disconnection cancels
+// the request context, which aborts the upstream request and releases its connection
+func (group *Group) prepareStreaming(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		slog.Debug("error clearing write deadline of streaming request", "group", group.Path, "error", err)
+	}
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Server-Sent Events endpoint sending an event every interval
+func eventStream(t *testing.T, events int, interval time.Duration) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := range events {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(interval):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestStreamingOutlivesWriteTimeout(t *testing.T) {
+	backend := eventStream(t, 5, 100*time.Millisecond)
+	conf := startTestConf(t, testBindConf(`"writeTimout": "150ms",`, `"streaming": true,`, backend.URL))
+
+	start := time.Now()
+	resp, err := http.Get("http://" + conf.Settings.Bind[0].listenAddr() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	for i := range 5 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+		if line != fmt.Sprintf("data: %d\n", i) {
+			t.Fatalf("event %d = %q", i, line)
+		}
+		//every event is flushed as soon as it is written
+		if i == 0 && time.Since(start) > 300*time.Millisecond {
+			t.Errorf("first event received after %v", time.Since(start))
+		}
+		reader.ReadString('\n')
+	}
+}
+
+func TestNonStreamingCutByWriteTimeout(t *testing.T) {
+	backend := eventStream(t, 5, 100*time.Millisecond)
+	conf := startTestConf(t, testBindConf(`"writeTimout": "150ms",`, "", backend.URL))
+
+	resp, err := http.Get("http://" + conf.Settings.Bind[0].listenAddr() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body strings.Builder
+	_, err = bufio.NewReader(resp.Body).WriteTo(&body)
+	if err == nil && strings.Contains(body.String(), "data: 4") {
+		t.Error("write timeout did not apply to a regular group")
+	}
+}
@@ -0,0 +1,394 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultConnectTimeout time.Duration = 5 * time.Second
+	DefaultRawIdleTimeout time.Duration = time.Hour
+)
+
+// settings of a group served by a raw (tcp or udp) bind, endpoints are addressed as
+// tcp://host:port, udp://host:port or host:port and balanced like HTTP ones.
+// sourceIP is the only stickiness mode available
+type Layer4 struct {
+	//tcp only
+	ConnectTimeout string `json:"connectTimeout,omitempty"`
+	//the connection (or udp flow) is closed when nothing flows in either direction for this long
+	IdleTimeout string `json:"idleTimeout,omitempty"`
+	//tlsPassthrough groups only: the group matches only clients offering one of these protocols
+	ALPN []string `json:"alpn,omitempty"`
+	//v1 or v2, sends the client address to the endpoint before any byte of the client.
+	//udp flows need v2, the header is sent with every datagram
+	ProxyProtocol string `json:"proxyProtocol,omitempty"`
+	//udp only, flows tracked at once, defaults to DefaultUDPMaxFlows
+	MaxFlows int `json:"maxFlows,omitempty"`
+	//udp only, buffer of every flow for the endpoint datagrams, longer ones are truncated.
+	//Defaults to DefaultUDPMaxDatagramSize
+	MaxDatagramSize int `json:"maxDatagramSize,omitempty"`
+
+	connectTimeout  time.Duration `json:"-"`
+	idleTimeout     time.Duration `json:"-"`
+	maxFlows        int           `json:"-"`
+	maxDatagramSize int           `json:"-"`
+}
+
+func (group *Group) initLayer4() error {
+	if group.Layer4 == nil {
+		group.Layer4 = &Layer4{}
+	}
+	settings := group.Layer4
+	if err := validProxyProtocol(settings.ProxyProtocol); err != nil {
+		return err
+	}
+	settings.connectTimeout = getWithDefaultDuration(settings.ConnectTimeout, DefaultConnectTimeout)
+	if group.raw == PROTO_UDP {
+		settings.idleTimeout = getWithDefaultDuration(settings.IdleTimeout, DefaultUDPIdleTimeout)
+		if strings.EqualFold(settings.ProxyProtocol, PROXY_PROTOCOL_V1) {
+			return errors.New("PROXY protocol v1 does not support udp, use v2")
+		}
+		if settings.MaxFlows < 0 {
+			return errors.New("maxFlows cannot be negative")
+		}
+		settings.maxFlows = settings.MaxFlows
+		if settings.maxFlows == 0 {
+			settings.maxFlows = DefaultUDPMaxFlows
+		}
+		if settings.MaxDatagramSize < 0 || settings.MaxDatagramSize > maxDatagramSize {
+			return fmt.Errorf("maxDatagramSize must be between 1 and %d", maxDatagramSize)
+		}
+		settings.maxDatagramSize = getWithDefaultInt(settings.MaxDatagramSize, DefaultUDPMaxDatagramSize)
+	} else {
+		settings.idleTimeout = getWithDefaultDuration(settings.IdleTimeout, DefaultRawIdleTimeout)
+	}
+
+	if group.TLSPassthrough && group.Address == "" {
+		return errors.New("tlsPassthrough groups need the server name as address")
+	}
+	if group.affinity != nil {
+		if _, ok := group.affinity.(*sourceIPAffinity); !ok {
+			return errors.New("raw connections can only be sticky by sourceIP")
+		}
+	}
+	if group.HealthCheck != nil && group.HealthCheck.Type == HEALTH_CHECK_GRPC {
+		return errors.New("gRPC health checks need an HTTP bind")
+	}
+	if group.HealthCheck != nil && group.HealthCheck.Type == HEALTH_CHECK_UDP && group.raw != PROTO_UDP {
+		return errors.New("udp health checks need an udp bind")
+	}
+	if group.GRPC || group.Streaming || group.Upgrade != nil || group.ClientCert != nil || group.Mirror != nil {
+		return errors.New("grpc, streaming, upgrade, clientCert and mirror need an HTTP bind")
+	}
+	//both are fed by the latency and the status of HTTP responses
+	if group.OutlierDetection != nil || strings.EqualFold(group.Algorithm, PEAK_EWMA) {
+		return errors.New("outlierDetection and the peakewma algorithm need an HTTP bind")
+	}
+	return nil
+}
+
+// host:port of the endpoint, the address is an URL (http, https, tcp, udp) or a bare host:port
+func (endpoint *Endpoint) hostPort() (string, error) {
+	if !strings.Contains(endpoint.Address, "://") {
+		if _, _, err := net.SplitHostPort(endpoint.Address); err != nil {
+			return "", err
+		}
+		return endpoint.Address, nil
+	}
+
+	u, err := url.Parse(endpoint.Address)
+	if err != nil {
+		return "", err
+	}
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+	switch u.Scheme {
+	case "http":
+		return net.JoinHostPort(u.Hostname(), "80"), nil
+	case "https":
+		return net.JoinHostPort(u.Hostname(), "443"), nil
+	}
+	return "", fmt.Errorf("endpoint %s has no port", endpoint.Address)
+}
+
+// endpoint of a new connection, the raw counterpart of the affinity handling in handleRequest
+func (group *Group) pickRawEndpoint(client net.Addr) (*Endpoint, error) {
+	sticky, ok := group.affinity.(*sourceIPAffinity)
+	if !ok {
+		return group.getBalancedEndpoint(nil, group.Endpoints)
+	}
+
+	ip := client.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	endpoint, err := sticky.table.get(ip)
+	switch {
+	case err != nil:
+		endpoint, err = group.getBalancedEndpoint(nil, group.Endpoints)
+		if err != nil {
+			return nil, err
+		}
+		sticky.table.put(ip, endpoint)
+	case !endpoint.acceptsSession():
+		switch group.sessionFailoverPolicy(endpoint) {
+		case FAILOVER_STRICT:
+			slog.Info("session endpoint not available, strict failover policy", "group", group.Address, "endpoint", endpoint.Address)
+			return nil, errors.New("sticky endpoint not available")
+		case FAILOVER_RETURN_WHEN_HEALTHY:
+			if fallback := sticky.table.getFallback(ip); fallback != nil && fallback.acceptsSession() {
+				return fallback, nil
+			}
+			fallback, err := group.getBalancedEndpoint(nil, group.Endpoints)
+			if err != nil {
+				return nil, err
+			}
+			sticky.table.setFallback(ip, fallback)
+			endpoint = fallback
+		default:
+			endpoint, err = group.getBalancedEndpoint(nil, group.Endpoints)
+			if err != nil {
+				return nil, err
+			}
+			sticky.table.put(ip, endpoint)
+		}
+	case group.failoverPolicy == FAILOVER_RETURN_WHEN_HEALTHY:
+		sticky.table.setFallback(ip, nil)
+	}
+	return endpoint, nil
+}
+
+// accepts the raw connections of a tcp bind
+type rawServer struct {
+	bind     *Bind
+	listener net.Listener
+	stopping atomic.Bool
+	wg       sync.WaitGroup
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func (bind *Bind) startRawServer() error {
+	ln, err := net.Listen("tcp", bind.Address)
+	if err != nil {
+		return err
+	}
+
+	server := &rawServer{bind: bind, listener: ln, conns: make(map[net.Conn]struct{})}
+	bind.raw = server
+
+	server.wg.Add(1)
+	go server.serve()
+	return nil
+}
+
+func (server *rawServer) serve() {
+	defer server.wg.Done()
+
+	var backoff time.Duration
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			if server.stopping.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			//same backoff as net/http on temporary accept errors (e.g. too many open files)
+			backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+			slog.Error("accept error on raw bind", "bind", server.bind.Address, "error", err, "retry", backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		if !server.track(conn) {
+			conn.Close()
+			return
+		}
+		go func() {
+			defer server.untrack(conn)
+			server.handle(conn)
+		}()
+	}
+}
+
+// false once the server is stopping, the connection must not be served
+func (server *rawServer) track(conn net.Conn) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.stopping.Load() {
+		return false
+	}
+	server.wg.Add(1)
+	server.conns[conn] = struct{}{}
+	return true
+}
+
+func (server *rawServer) untrack(conn net.Conn) {
+	server.mu.Lock()
+	delete(server.conns, conn)
+	server.mu.Unlock()
+	server.wg.Done()
+}
+
+func (server *rawServer) handle(conn net.Conn) {
+	bind := server.bind
+	panicked := catchUnwind(func() {
+		var head []byte
+		if bind.hasPassthrough() {
+			var spliced bool
+			if spliced, head = bind.passthrough(conn); spliced {
+				return
+			}
+		}
+
+		//raw connections carry no host, the first group not routed by SNI is served
+		group := bind.firstGroup()
+		if group == nil {
+			slog.Debug("no group for raw connection", "bind", bind.Address, "client", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+		group.proxyRaw(bind.Address, conn, head)
+	})
+	if panicked {
+		conn.Close()
+	}
+}
+
+// connects the client to an endpoint of the group and pipes the bytes both ways, head is
+// sent to the endpoint before anything else the client writes. The client is closed on return
+func (group *Group) proxyRaw(bindName string, client net.Conn, head []byte) {
+	defer client.Close()
+
+	var upstream net.Conn
+	var endpoint *Endpoint
+	for attempt := 0; ; attempt++ {
+		var err error
+		endpoint, err = group.pickRawEndpoint(client.RemoteAddr())
+		if err != nil {
+			slog.Debug("no endpoint for raw connection", "bind", bindName, "client", client.RemoteAddr(), "error", err)
+			return
+		}
+
+		address, err := endpoint.hostPort()
+		if err == nil {
+			upstream, err = net.DialTimeout("tcp", address, group.Layer4.connectTimeout)
+		}
+		if err == nil {
+			break
+		}
+
+		slog.Debug("error connecting to endpoint", "endpoint", endpoint.Address, "error", err)
+		group.conf.metrics.rawConnectErrorsTotal.with(bindName, endpoint.Address).inc()
+		endpoint.setAlive(false)
+		if attempt >= maxRetry {
+			slog.Debug("retried too many times another endpoint, giving up", "bind", bindName)
+			return
+		}
+	}
+	defer upstream.Close()
+
+	if group.Layer4.ProxyProtocol != "" {
+		header, err := proxyProtocolHeader(group.Layer4.ProxyProtocol, client.RemoteAddr(), client.LocalAddr())
+		if err != nil {
+			slog.Debug("cannot build PROXY protocol header", "client", client.RemoteAddr(), "error", err)
+			return
+		}
+		head = append(header, head...)
+	}
+	if len(head) != 0 {
+		upstream.SetWriteDeadline(time.Now().Add(group.Layer4.connectTimeout))
+		if _, err := upstream.Write(head); err != nil {
+			slog.Debug("error writing to endpoint", "endpoint", endpoint.Address, "error", err)
+			return
+		}
+		upstream.SetWriteDeadline(time.Time{})
+	}
+
+	endpoint.ActiveConnections.Add(1)
+	defer endpoint.ActiveConnections.Add(^uint64(0))
+	open := group.conf.metrics.rawConnections.with(bindName, endpoint.Address)
+	open.inc()
+	defer open.dec()
+	group.conf.metrics.rawConnectionsTotal.with(bindName, endpoint.Address).inc()
+
+	//both sides carry the idle deadline: once the client half closes, only the upstream
+	//is read and a silent endpoint must not keep the connection forever
+	idleClient := &idleConn{Conn: client, timeout: group.Layer4.idleTimeout}
+	idleClient.touch()
+	idleUpstream := &idleConn{Conn: upstream, timeout: group.Layer4.idleTimeout}
+	idleUpstream.touch()
+	splice(idleClient, idleUpstream)
+}
+
+// copies both ways until both sides are done: a clean EOF is forwarded as a half close,
+// an error (including the idle timeout) aborts the whole connection
+func splice(client net.Conn, upstream net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pipe(upstream, client)
+	}()
+	pipe(client, upstream)
+	<-done
+}
+
+func pipe(dst net.Conn, src net.Conn) {
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		src.Close()
+		return
+	}
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	dst.Close()
+}
+
+// stops accepting and waits for the connections, the ones left when ctx expires are closed
+func (server *rawServer) Stop(ctx context.Context) error {
+	server.mu.Lock()
+	server.stopping.Store(true)
+	server.mu.Unlock()
+
+	//nil when the connections are accepted by a passthroughListener
+	var err error
+	if server.listener != nil {
+		err = server.listener.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		server.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	server.mu.Lock()
+	for conn := range server.conns {
+		conn.Close()
+	}
+	server.mu.Unlock()
+	<-done
+	return errors.Join(err, ctx.Err())
+}
@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listenTCP(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+func rawGroup(t *testing.T, network string, layer4 *Layer4, addresses ...string) *Group {
+	t.Helper()
+	group := &Group{Layer4: layer4, raw: network, conf: &Conf{metrics: newBalancerMetrics()}}
+	for _, address := range addresses {
+		group.Endpoints = append(group.Endpoints, aliveEndpoint(address))
+	}
+	if err := group.initBalancing(); err != nil {
+		t.Fatal(err)
+	}
+	if err := group.initLayer4(); err != nil {
+		t.Fatal(err)
+	}
+	return group
+}
+
+// the client connection as accepted by a raw bind, proxied by group in background
+func proxiedClient(t *testing.T, group *Group) net.Conn {
+	t.Helper()
+	front := listenTCP(t)
+	go func() {
+		conn, err := front.Accept()
+		if err != nil {
+			return
+		}
+		group.proxyRaw(front.Addr().String(), conn, nil)
+	}()
+
+	client, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestProxyRawProxyProtocol(t *testing.T) {
+	backend := listenTCP(t)
+	group := rawGroup(t, PROTO_TCP, &Layer4{ProxyProtocol: PROXY_PROTOCOL_V1}, "tcp://"+backend.Addr().String())
+	client := proxiedClient(t, group)
+
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := backend.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(line, "PROXY TCP4 127.0.0.1 127.0.0.1 ") {
+		t.Errorf("PROXY header = %q", line)
+	}
+	payload := make([]byte, 5)
+	if _, err := io.ReadFull(reader, payload); err != nil || string(payload) != "hello" {
+		t.Errorf("payload = %q, %v", payload, err)
+	}
+
+	if _, err := conn.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(client, payload); err != nil || string(payload) != "world" {
+		t.Errorf("response = %q, %v", payload, err)
+	}
+}
+
+func TestProxyRawIdleAfterHalfClose(t *testing.T) {
+	backend := listenTCP(t)
+	group := rawGroup(t, PROTO_TCP, &Layer4{IdleTimeout: "200ms"}, backend.Addr().String())
+	client := proxiedClient(t, group)
+
+	//the endpoint never answers nor closes
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	client.Write([]byte("request"))
+	client.(*net.TCPConn).CloseWrite()
+
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("endpoint not connected")
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	if _, err := io.ReadAll(client); err != nil {
+		t.Fatalf("connection not closed by the idle timeout: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("connection closed after %v", elapsed)
+	}
+}
+
+func TestProxyRawConnectFailure(t *testing.T) {
+	//nothing listens on the address of a closed listener
+	closed := listenTCP(t)
+	address := closed.Addr().String()
+	closed.Close()
+
+	group := rawGroup(t, PROTO_TCP, &Layer4{ConnectTimeout: "1s"}, address)
+	client := proxiedClient(t, group)
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(client); err != nil {
+		t.Fatalf("client not closed: %v", err)
+	}
+	if group.Endpoints[0].Alive.Load() {
+		t.Error("unreachable endpoint still alive")
+	}
+}
+
+func TestLayer4RejectsHTTPFeatures(t *testing.T) {
+	tests := map[string]*Group{
+		"grpc":              {GRPC: true},
+		"mirror":            {Mirror: &Mirror{}},
+		"outlier detection": {OutlierDetection: &OutlierDetection{}},
+		"peak ewma":         {Algorithm: "PeakEWMA"},
+	}
+	for name, group := range tests {
+		for _, network := range []string{PROTO_TCP, PROTO_UDP} {
+			group.raw = network
+			if err := group.initLayer4(); err == nil {
+				t.Errorf("%s accepted on a %s group", name, network)
+			}
+		}
+	}
+}
+
+func TestEndpointHostPort(t *testing.T) {
+	tests := map[string]string{
+		"db:5432":                "db:5432",
+		"tcp://db:5432":          "db:5432",
+		"udp://[2001:db8::1]:53": "[2001:db8::1]:53",
+		"http://example.com":     "example.com:80",
+		"https://example.com/x":  "example.com:443",
+	}
+	for address, want := range tests {
+		got, err := (&Endpoint{Address: address}).hostPort()
+		if err != nil || got != want {
+			t.Errorf("hostPort(%q) = %q, %v, want %q", address, got, err, want)
+		}
+	}
+
+	for _, address := range []string{"db", "tcp://db"} {
+		if _, err := (&Endpoint{Address: address}).hostPort(); err == nil {
+			t.Errorf("hostPort(%q) accepted an address without port", address)
+		}
+	}
+}
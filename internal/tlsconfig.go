@@ -0,0 +1,288 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//rotated keys kept to decrypt tickets issued before the last rotations
+	sessionTicketKeysKept = 3
+	//reload interval of the shared keys file when no rotation is configured
+	DefaultSessionTicketReload time.Duration = time.Hour
+)
+
+// protocol and cipher suite policy of a bind, unset fields keep Go defaults
+type TLSPolicy struct {
+	//"1.0", "1.1", "1.2" or "1.3"
+	MinVersion string `json:"minVersion,omitempty"`
+	MaxVersion string `json:"maxVersion,omitempty"`
+	//Go names, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS 1.3 suites are not configurable
+	CipherSuites []string `json:"cipherSuites,omitempty"`
+	//X25519, P256, P384 or P521
+	CurvePreferences []string `json:"curvePreferences,omitempty"`
+	//ALPN protocols in preference order, h2 is disabled when missing from a non empty list
+	ALPN []string `json:"alpn,omitempty"`
+
+	DisableSessionTickets bool `json:"disableSessionTickets,omitempty"`
+	//shared ticket keys, one 32 bytes key per line hex or base64 encoded, the first one
+	//encrypts new tickets, relative to basePath. Instances using the same file resume
+	//each other's sessions
+	SessionTicketKeysFileName string `json:"sessionTicketKeysFileName,omitempty"`
+	//rotation interval of random keys, or reload interval of the keys file
+	SessionTicketRotation string `json:"sessionTicketRotation,omitempty"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"x25519":    tls.X25519,
+	"p256":      tls.CurveP256,
+	"p-256":     tls.CurveP256,
+	"curvep256": tls.CurveP256,
+	"p384":      tls.CurveP384,
+	"p-384":     tls.CurveP384,
+	"curvep384": tls.CurveP384,
+	"p521":      tls.CurveP521,
+	"p-521":     tls.CurveP521,
+	"curvep521": tls.CurveP521,
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[strings.TrimPrefix(strings.ToUpper(version), "TLS")]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", version)
+	}
+	return v, nil
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := append(tls.CipherSuites(), tls.InsecureCipherSuites()...)
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		index := slices.IndexFunc(known, func(suite *tls.CipherSuite) bool { return suite.Name == name })
+		if index < 0 {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+
+		suite := known[index]
+		if slices.Equal(suite.SupportedVersions, []uint16{tls.VersionTLS13}) {
+			slog.Warn("TLS 1.3 cipher suites are not configurable, ignoring", "cipherSuite", name)
+			continue
+		}
+		if suite.Insecure {
+			slog.Warn("insecure cipher suite enabled", "cipherSuite", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+func (policy *TLSPolicy) apply(config *tls.Config) error {
+	var err error
+	if policy.MinVersion != "" {
+		if config.MinVersion, err = parseTLSVersion(policy.MinVersion); err != nil {
+			return err
+		}
+	}
+
+	if policy.MaxVersion != "" {
+		if config.MaxVersion, err = parseTLSVersion(policy.MaxVersion); err != nil {
+			return err
+		}
+	}
+
+	if config.MinVersion != 0 && config.MaxVersion != 0 && config.MinVersion > config.MaxVersion {
+		return errors.New("TLS minVersion is greater than maxVersion")
+	}
+
+	if len(policy.CipherSuites) != 0 {
+		if config.CipherSuites, err = parseCipherSuites(policy.CipherSuites); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range policy.CurvePreferences {
+		curve, ok := tlsCurves[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unknown curve %q", name)
+		}
+		config.CurvePreferences = append(config.CurvePreferences, curve)
+	}
+
+	config.NextProtos = policy.ALPN
+	config.SessionTicketsDisabled = policy.DisableSessionTickets
+	return nil
+}
+
+// true when the policy removes h2 from the negotiated protocols
+func (policy *TLSPolicy) disablesHTTP2() bool {
+	return policy != nil && len(policy.ALPN) != 0 && !slices.Contains(policy.ALPN, "h2")
+}
+
+// keeps the session ticket keys of a bind, the configuration actually used by the
+// handshakes is swapped at every rotation because servers work on clones of the bind one
+type ticketKeys struct {
+	base     *tls.Config
+	current  atomic.Pointer[tls.Config]
+	keys     [][32]byte
+	fileName string
+	stop     chan struct{}
+}
+
+func newTicketKeys(base *tls.Config, policy *TLSPolicy, basePath string) (*ticketKeys, error) {
+	tk := &ticketKeys{base: base.Clone(), stop: make(chan struct{})}
+
+	//http.Server adds h2 to its own clone only, the swapped configuration must announce it
+	if len(tk.base.NextProtos) == 0 {
+		tk.base.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	if policy.SessionTicketKeysFileName != "" {
+		tk.fileName = path.Join(basePath, policy.SessionTicketKeysFileName)
+	}
+
+	if err := tk.rotate(); err != nil {
+		return nil, err
+	}
+
+	interval := getWithDefaultDuration(policy.SessionTicketRotation, DefaultSessionTicketReload)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-tk.stop:
+				return
+			case <-ticker.C:
+				if err := tk.rotate(); err != nil {
+					slog.Error("error rotating session ticket keys", "error", err)
+				}
+			}
+		}
+	}()
+
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return tk.current.Load(), nil
+	}
+	return tk, nil
+}
+
+func (tk *ticketKeys) rotate() error {
+	if tk.fileName != "" {
+		keys, err := readTicketKeys(tk.fileName)
+		if err != nil {
+			return err
+		}
+		tk.keys = keys
+	} else {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		tk.keys = append([][32]byte{key}, tk.keys[:min(len(tk.keys), sessionTicketKeysKept-1)]...)
+	}
+
+	config := tk.base.Clone()
+	config.SetSessionTicketKeys(tk.keys)
+	tk.current.Store(config)
+	return nil
+}
+
+func (tk *ticketKeys) Stop() {
+	close(tk.stop)
+}
+
+func readTicketKeys(fileName string) ([][32]byte, error) {
+	read, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys [][32]byte
+	scanner := bufio.NewScanner(bytes.NewReader(read))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		decoded, err := hex.DecodeString(line)
+		if err != nil {
+			decoded, err = base64.StdEncoding.DecodeString(line)
+		}
+		if err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("invalid session ticket key in %s, 32 bytes hex or base64 expected", fileName)
+		}
+		keys = append(keys, [32]byte(decoded))
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no session ticket key in %s", fileName)
+	}
+	return keys, nil
+}
+
+// server side TLS configuration shared by all the servers of the bind, nil without certificates
+func (bind *Bind) serverTLSConfig() (*tls.Config, error) {
+	if bind.ClientAuth != nil {
+		bind.ClientAuth.defaultHeaders()
+	}
+	if len(bind.SSL) == 0 {
+		return nil, nil
+	}
+
+	config := &tls.Config{Certificates: bind.generateServerTLS()}
+
+	if bind.ClientAuth != nil {
+		if err := bind.ClientAuth.apply(config, bind.conf.BasePath); err != nil {
+			return nil, err
+		}
+	}
+
+	if bind.OCSP != nil && bind.OCSP.Enable {
+		stapler, err := newOCSPStapler(config.Certificates, bind.OCSP, bind.conf.BasePath)
+		if err != nil {
+			return nil, err
+		}
+		if stapler != nil {
+			config.Certificates = nil
+			config.GetCertificate = stapler.getCertificate
+			bind.stapler = stapler
+		}
+	}
+
+	if bind.TLS != nil {
+		if err := bind.TLS.apply(config); err != nil {
+			return nil, err
+		}
+
+		if !bind.TLS.DisableSessionTickets && (bind.TLS.SessionTicketKeysFileName != "" || bind.TLS.SessionTicketRotation != "") {
+			tk, err := newTicketKeys(config, bind.TLS, bind.conf.BasePath)
+			if err != nil {
+				return nil, err
+			}
+			bind.ticketKeys = tk
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTLSPolicyApply(t *testing.T) {
+	policy := &TLSPolicy{
+		MinVersion:       "1.2",
+		MaxVersion:       "TLS1.3",
+		CipherSuites:     []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_AES_128_GCM_SHA256"},
+		CurvePreferences: []string{"X25519", "P-256"},
+		ALPN:             []string{"http/1.1"},
+	}
+	config := &tls.Config{}
+	if err := policy.apply(config); err != nil {
+		t.Fatal(err)
+	}
+
+	if config.MinVersion != tls.VersionTLS12 || config.MaxVersion != tls.VersionTLS13 {
+		t.Errorf("versions = %x-%x", config.MinVersion, config.MaxVersion)
+	}
+	//TLS 1.3 suites are ignored
+	if !slices.Equal(config.CipherSuites, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}) {
+		t.Errorf("cipher suites = %x", config.CipherSuites)
+	}
+	if !slices.Equal(config.CurvePreferences, []tls.CurveID{tls.X25519, tls.CurveP256}) {
+		t.Errorf("curves = %v", config.CurvePreferences)
+	}
+	if !policy.disablesHTTP2() {
+		t.Error("ALPN without h2 keeps HTTP/2")
+	}
+}
+
+func TestTLSPolicyErrors(t *testing.T) {
+	tests := map[string]*TLSPolicy{
+		"unknown version":      {MinVersion: "1.4"},
+		"min above max":        {MinVersion: "1.3", MaxVersion: "1.2"},
+		"unknown cipher suite": {CipherSuites: []string{"TLS_NULL"}},
+		"unknown curve":        {CurvePreferences: []string{"P192"}},
+	}
+	for name, policy := range tests {
+		if err := policy.apply(&tls.Config{}); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestReadTicketKeys(t *testing.T) {
+	dir := t.TempDir()
+	first, second := make([]byte, 32), make([]byte, 32)
+	for i := range first {
+		first[i], second[i] = byte(i), byte(255-i)
+	}
+
+	write := func(name string, lines ...string) string {
+		fileName := filepath.Join(dir, name)
+		if err := os.WriteFile(fileName, []byte(strings.Join(lines, "\n")), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return fileName
+	}
+
+	keys, err := readTicketKeys(write("keys", "# current key first", hex.EncodeToString(first), "", base64.StdEncoding.EncodeToString(second)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != [32]byte(first) || keys[1] != [32]byte(second) {
+		t.Errorf("keys = %x", keys)
+	}
+
+	for name, content := range map[string]string{
+		"short": hex.EncodeToString(first[:16]),
+		"empty": "# no key",
+		"junk":  "not a key",
+	} {
+		if _, err := readTicketKeys(write(name, content)); err == nil {
+			t.Errorf("%s keys file accepted", name)
+		}
+	}
+}
+
+func TestTicketKeysRotation(t *testing.T) {
+	base := &tls.Config{}
+	tk, err := newTicketKeys(base, &TLSPolicy{SessionTicketRotation: "1h"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tk.Stop()
+
+	for range sessionTicketKeysKept + 2 {
+		if err := tk.rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(tk.keys) != sessionTicketKeysKept {
+		t.Errorf("%d keys kept, want %d", len(tk.keys), sessionTicketKeysKept)
+	}
+
+	config, err := base.GetConfigForClient(nil)
+	if err != nil || config != tk.current.Load() {
+		t.Fatalf("handshakes do not use the rotated configuration: %v", err)
+	}
+	if !slices.Equal(config.NextProtos, []string{"h2", "http/1.1"}) {
+		t.Errorf("rotated configuration announces %v", config.NextProtos)
+	}
+}
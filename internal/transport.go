@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+)
+
+const (
+	UPSTREAM_H1  = "h1"
+	UPSTREAM_H2  = "h2"
+	UPSTREAM_H2C = "h2c"
+	UPSTREAM_H3  = "h3"
+
+	//h3Fallback value disabling the TCP fallback
+	H3_FALLBACK_NONE = "none"
+
+	//QUIC is not tried again before this delay once the fallback kicked in
+	h3FallbackInterval time.Duration = time.Minute
+	//short, a blocked UDP path is only detected when the handshake times out
+	h3HandshakeTimeout time.Duration = 3 * time.Second
+)
+
+// transport used by the reverse proxy of the endpoint, h1 may still negotiate h2 through ALPN
+// when the endpoint is https, h2 forces HTTP/2 over TLS, h2c speaks cleartext HTTP/2 with
+// prior knowledge and h3 uses QUIC falling back to TCP when it cannot be reached
+func (endpoint *Endpoint) newTransport(protocol string) (http.RoundTripper, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: endpoint.TLSInsecureSkipVerify}
+
+	switch protocol {
+	case UPSTREAM_H1:
+		return &http.Transport{
+			//todo timouts and more...
+			TLSClientConfig: tlsConfig,
+		}, nil
+	case UPSTREAM_H2:
+		return &http2.Transport{TLSClientConfig: tlsConfig}, nil
+	case UPSTREAM_H2C:
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, addr)
+			},
+		}, nil
+	case UPSTREAM_H3:
+		return endpoint.newH3Transport(tlsConfig)
+	default:
+		return nil, fmt.Errorf("unknown upstream protocol %q", protocol)
+	}
+}
+
+// gRPC needs HTTP/2, gRPC groups default to h2 or h2c depending on the endpoint scheme
+func (endpoint *Endpoint) upstreamProtocol(group *Group, address *url.URL) (string, error) {
+	protocol := strings.ToLower(endpoint.UpstreamProtocol)
+	http2 := protocol == UPSTREAM_H2 || protocol == UPSTREAM_H2C
+
+	if protocol == UPSTREAM_H3 && address.Scheme != "https" {
+		return "", fmt.Errorf("endpoint %s: h3 requires an https address", endpoint.Address)
+	}
+
+	if group.GRPC && protocol == "" {
+		if address.Scheme == "https" {
+			return UPSTREAM_H2, nil
+		}
+		return UPSTREAM_H2C, nil
+	}
+
+	if !http2 && (group.GRPC || (group.HealthCheck != nil && group.HealthCheck.Type == HEALTH_CHECK_GRPC)) {
+		return "", fmt.Errorf("endpoint %s: gRPC requires an h2 or h2c upstream protocol", endpoint.Address)
+	}
+
+	if protocol == "" {
+		return UPSTREAM_H1, nil
+	}
+	return protocol, nil
+}
+
+func (endpoint *Endpoint) newH3Transport(tlsConfig *tls.Config) (http.RoundTripper, error) {
+	if endpoint.Upstream0RTT {
+		//0-RTT needs the session of a previous connection
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+
+	transport := &h3Transport{
+		h3: &http3.RoundTripper{
+			TLSClientConfig: tlsConfig,
+			QUICConfig:      &quic.Config{HandshakeIdleTimeout: h3HandshakeTimeout},
+		},
+		early:   endpoint.Upstream0RTT,
+		address: endpoint.Address,
+	}
+
+	switch fallback := strings.ToLower(endpoint.H3Fallback); fallback {
+	case H3_FALLBACK_NONE:
+	case "", UPSTREAM_H1, UPSTREAM_H2:
+		if fallback == "" {
+			fallback = UPSTREAM_H1
+		}
+		var err error
+		if transport.fallback, err = endpoint.newTransport(fallback); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown h3 fallback %q", endpoint.H3Fallback)
+	}
+
+	return transport, nil
+}
+
+// HTTP/3 to the endpoint, requests go through the TCP fallback for a while once
+// the QUIC handshake could not complete, e.g. because UDP is filtered
+type h3Transport struct {
+	h3       *http3.RoundTripper
+	fallback http.RoundTripper
+	//GET and HEAD are sent as 0-RTT early data on resumed connections
+	early   bool
+	address string
+	//unix nano time until which QUIC is skipped
+	quicBlockedUntil atomic.Int64
+}
+
+func (t *h3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.fallback != nil && time.Now().UnixNano() < t.quicBlockedUntil.Load() {
+		return t.fallback.RoundTrip(req)
+	}
+
+	resp, err := t.h3.RoundTrip(t.earlyRequest(req))
+	if err == nil {
+		resp.Request = req
+		return resp, nil
+	}
+
+	if t.fallback == nil || req.Context().Err() != nil || !quicUnreachable(err, req) {
+		return nil, err
+	}
+
+	//the request has not been sent, unless it was early data which is idempotent anyway,
+	//but a body already consumed cannot be sent again
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, err
+		}
+		body, bodyErr := req.GetBody()
+		if bodyErr != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+
+	t.quicBlockedUntil.Store(time.Now().Add(h3FallbackInterval).UnixNano())
+	slog.Warn("endpoint unreachable over QUIC, falling back to TCP", "endpoint", t.address, "retryIn", h3FallbackInterval, "error", err)
+	return t.fallback.RoundTrip(req)
+}
+
+func (t *h3Transport) earlyRequest(req *http.Request) *http.Request {
+	if !t.early {
+		return req
+	}
+
+	var method string
+	switch req.Method {
+	case http.MethodGet:
+		method = http3.MethodGet0RTT
+	case http.MethodHead:
+		method = http3.MethodHead0RTT
+	default:
+		return req
+	}
+
+	early := req.Clone(req.Context())
+	early.Method = method
+	return early
+}
+
+// true when the error tells that no QUIC connection could be established, an idle
+// timeout may also happen after the request was sent so only idempotent requests qualify
+func quicUnreachable(err error, req *http.Request) bool {
+	var handshakeTimeout *quic.HandshakeTimeoutError
+	var opError *net.OpError
+	if errors.As(err, &handshakeTimeout) || errors.As(err, &opError) {
+		return true
+	}
+
+	var idleTimeout *quic.IdleTimeoutError
+	if errors.As(err, &idleTimeout) {
+		switch req.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+func TestH3FallbackToTCP(t *testing.T) {
+	t.Parallel()
+	//TLS over TCP only, nothing answers QUIC on the same port
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	defer backend.Close()
+
+	endpoint := &Endpoint{Address: backend.URL, TLSInsecureSkipVerify: true}
+	transport, err := endpoint.newTransport(UPSTREAM_H3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		req := httptest.NewRequest(http.MethodGet, backend.URL, nil)
+		req.RequestURI = ""
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "HTTP/1.1" {
+			t.Errorf("endpoint reached over %q", body)
+		}
+	}
+
+	h3 := transport.(*h3Transport)
+	if until := time.Unix(0, h3.quicBlockedUntil.Load()); time.Until(until) <= 0 {
+		t.Error("QUIC not skipped after the fallback")
+	}
+}
+
+func TestH3WithoutFallback(t *testing.T) {
+	t.Parallel()
+	backend := httptest.NewTLSServer(http.NotFoundHandler())
+	defer backend.Close()
+
+	endpoint := &Endpoint{Address: backend.URL, TLSInsecureSkipVerify: true, H3Fallback: H3_FALLBACK_NONE}
+	transport, err := endpoint.newTransport(UPSTREAM_H3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, backend.URL, nil)
+	req.RequestURI = ""
+	if resp, err := transport.RoundTrip(req); err == nil {
+		resp.Body.Close()
+		t.Error("request answered without QUIC nor fallback")
+	}
+
+	if _, err := (&Endpoint{Address: backend.URL, H3Fallback: "h4"}).newTransport(UPSTREAM_H3); err == nil {
+		t.Error("unknown fallback accepted")
+	}
+}
+
+func TestH3EarlyRequest(t *testing.T) {
+	transport := &h3Transport{early: true}
+	tests := map[string]string{
+		http.MethodGet:  http3.MethodGet0RTT,
+		http.MethodHead: http3.MethodHead0RTT,
+		http.MethodPost: http.MethodPost,
+	}
+	for method, want := range tests {
+		req := httptest.NewRequest(method, "https://example.com/", nil)
+		if got := transport.earlyRequest(req).Method; got != want {
+			t.Errorf("%s sent as %s, want %s", method, got, want)
+		}
+		if req.Method != method {
+			t.Errorf("%s request modified", method)
+		}
+	}
+}
+
+func TestUpstreamProtocol(t *testing.T) {
+	parse := func(address string) *url.URL {
+		u, err := url.Parse(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	tests := []struct {
+		name     string
+		protocol string
+		group    *Group
+		address  string
+		want     string
+	}{
+		{"default", "", &Group{}, "http://a", UPSTREAM_H1},
+		{"h3", "H3", &Group{}, "https://a", UPSTREAM_H3},
+		{"grpc over tls", "", &Group{GRPC: true}, "https://a", UPSTREAM_H2},
+		{"grpc cleartext", "", &Group{GRPC: true}, "http://a", UPSTREAM_H2C},
+	}
+	for _, test := range tests {
+		endpoint := &Endpoint{Address: test.address, UpstreamProtocol: test.protocol}
+		got, err := endpoint.upstreamProtocol(test.group, parse(test.address))
+		if err != nil || got != test.want {
+			t.Errorf("%s: protocol %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+
+	if _, err := (&Endpoint{Address: "http://a", UpstreamProtocol: UPSTREAM_H3}).upstreamProtocol(&Group{}, parse("http://a")); err == nil {
+		t.Error("h3 accepted on a cleartext address")
+	}
+	if _, err := (&Endpoint{Address: "http://a", UpstreamProtocol: UPSTREAM_H1}).upstreamProtocol(&Group{GRPC: true}, parse("http://a")); err == nil {
+		t.Error("gRPC accepted over HTTP/1.1")
+	}
+}
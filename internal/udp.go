@@ -0,0 +1,314 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultUDPIdleTimeout time.Duration = 30 * time.Second
+	//flows tracked by an udp bind, datagrams of new clients are dropped beyond it. Every
+	//flow holds a socket, half of the usual 1024 open files limit
+	DefaultUDPMaxFlows = 512
+	//endpoint datagrams read by a flow, enough for DNS with EDNS and jumbo frames
+	DefaultUDPMaxDatagramSize = 9000
+
+	//largest UDP payload
+	maxDatagramSize = 1<<16 - 1
+	//an endpoint answering the probe with ICMP port unreachable is down, silence means up
+	udpHealthCheckWait = 500 * time.Millisecond
+
+	udpDropNoEndpoint = "no_endpoint"
+	udpDropMaxFlows   = "max_flows"
+	udpDropDialError  = "dial_error"
+)
+
+var (
+	errUDPMaxFlows = errors.New("too many udp flows")
+	errUDPDial     = errors.New("cannot open udp socket")
+)
+
+// datagrams of a client address go to the same endpoint until the flow is idle, the
+// endpoint answers through a connected socket owned by the flow
+type udpFlow struct {
+	client   netip.AddrPort
+	endpoint *Endpoint
+	upstream *net.UDPConn
+	//v2 PROXY protocol header sent with every datagram, nil when disabled
+	header []byte
+	//unix nano time of the last datagram in either direction
+	lastActivity atomic.Int64
+}
+
+func (flow *udpFlow) touch() {
+	flow.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (flow *udpFlow) idleFor() time.Duration {
+	return time.Duration(time.Now().UnixNano() - flow.lastActivity.Load())
+}
+
+// forwards the datagrams of a udp bind
+type udpServer struct {
+	bind     *Bind
+	group    *Group
+	conn     *net.UDPConn
+	metrics  *balancerMetrics
+	stopping atomic.Bool
+	wg       sync.WaitGroup
+
+	mu    sync.Mutex
+	flows map[netip.AddrPort]*udpFlow
+}
+
+func (bind *Bind) startUDPServer() error {
+	address, err := net.ResolveUDPAddr("udp", bind.Address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", address)
+	if err != nil {
+		return err
+	}
+
+	//datagrams carry no host, only the first group is served
+	server := &udpServer{bind: bind, group: bind.Groups[0], conn: conn, metrics: bind.conf.metrics, flows: make(map[netip.AddrPort]*udpFlow)}
+	bind.udp = server
+
+	server.wg.Add(1)
+	go server.serve()
+	return nil
+}
+
+func (server *udpServer) serve() {
+	defer server.wg.Done()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := server.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if server.stopping.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("read error on udp bind", "bind", server.bind.Address, "error", err)
+			continue
+		}
+
+		flow, err := server.flow(client)
+		if err != nil {
+			reason := udpDropNoEndpoint
+			switch {
+			case errors.Is(err, errUDPMaxFlows):
+				reason = udpDropMaxFlows
+			case errors.Is(err, errUDPDial):
+				reason = udpDropDialError
+			}
+			slog.Debug("udp datagram dropped", "bind", server.bind.Address, "client", client, "error", err)
+			server.metrics.udpDatagramsDroppedTotal.with(server.bind.Address, reason).inc()
+			continue
+		}
+
+		flow.touch()
+		datagram := buf[:n]
+		if flow.header != nil {
+			datagram = append(flow.header[:len(flow.header):len(flow.header)], datagram...)
+		}
+		if _, err := flow.upstream.Write(datagram); err != nil {
+			slog.Debug("error writing to endpoint", "endpoint", flow.endpoint.Address, "error", err)
+			server.endFlow(flow, err)
+		}
+	}
+}
+
+// flow of the client, a new one is bound to an endpoint chosen like a tcp connection.
+// Flows are only created by serve, the lock is not held while dialing the endpoint
+func (server *udpServer) flow(client netip.AddrPort) (*udpFlow, error) {
+	server.mu.Lock()
+	flow, ok := server.flows[client]
+	flows := len(server.flows)
+	server.mu.Unlock()
+
+	if ok {
+		return flow, nil
+	}
+	if server.stopping.Load() {
+		return nil, errors.New("udp bind stopping")
+	}
+	group := server.group
+	if flows >= group.Layer4.maxFlows {
+		return nil, errUDPMaxFlows
+	}
+
+	clientAddr := net.UDPAddrFromAddrPort(client)
+	endpoint, err := group.pickRawEndpoint(clientAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamAddr := endpoint.udpAddr.Load()
+	if upstreamAddr == nil {
+		return nil, errors.New("endpoint address not resolved")
+	}
+	//nothing is sent while dialing, the error is local (open files, buffers) and says
+	//nothing about the endpoint
+	upstream, err := net.DialUDP("udp", nil, upstreamAddr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errUDPDial, err)
+	}
+
+	flow = &udpFlow{client: client, endpoint: endpoint, upstream: upstream}
+	if group.Layer4.ProxyProtocol != "" {
+		//the destination is the bind address, unspecified when listening on every interface
+		flow.header, err = proxyProtocolHeader(group.Layer4.ProxyProtocol, clientAddr, server.conn.LocalAddr())
+		if err != nil {
+			upstream.Close()
+			return nil, err
+		}
+	}
+	flow.touch()
+
+	server.mu.Lock()
+	if server.stopping.Load() {
+		server.mu.Unlock()
+		upstream.Close()
+		return nil, errors.New("udp bind stopping")
+	}
+	server.flows[client] = flow
+	server.wg.Add(1)
+	server.mu.Unlock()
+
+	endpoint.ActiveConnections.Add(1)
+	server.metrics.udpFlows.with(server.bind.Address, endpoint.Address).inc()
+	server.metrics.udpFlowsTotal.with(server.bind.Address, endpoint.Address).inc()
+
+	go server.reply(flow)
+	return flow, nil
+}
+
+// sends the endpoint datagrams back to the client until the flow is idle, datagrams
+// longer than maxDatagramSize are truncated
+func (server *udpServer) reply(flow *udpFlow) {
+	defer server.wg.Done()
+
+	idleTimeout := server.group.Layer4.idleTimeout
+	buf := make([]byte, server.group.Layer4.maxDatagramSize)
+	for {
+		flow.upstream.SetReadDeadline(time.Now().Add(idleTimeout - flow.idleFor()))
+		n, err := flow.upstream.Read(buf)
+		if n > 0 {
+			flow.touch()
+			if _, err := server.conn.WriteToUDPAddrPort(buf[:n], flow.client); err != nil {
+				slog.Debug("error writing to udp client", "client", flow.client, "error", err)
+			}
+		}
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) && flow.idleFor() < idleTimeout {
+			continue
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, net.ErrClosed) {
+			err = nil
+		}
+		server.endFlow(flow, err)
+		return
+	}
+}
+
+// removes the flow, the next datagram of the client starts a new one. A refused
+// datagram (ICMP port unreachable) takes the endpoint down until the next health check
+func (server *udpServer) endFlow(flow *udpFlow, err error) {
+	server.mu.Lock()
+	current, ok := server.flows[flow.client]
+	if !ok || current != flow {
+		server.mu.Unlock()
+		return
+	}
+	delete(server.flows, flow.client)
+	server.mu.Unlock()
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		slog.Debug("endpoint refused udp datagrams", "endpoint", flow.endpoint.Address)
+		flow.endpoint.setAlive(false)
+	}
+
+	flow.upstream.Close()
+	flow.endpoint.ActiveConnections.Add(^uint64(0))
+	server.metrics.udpFlows.with(server.bind.Address, flow.endpoint.Address).dec()
+}
+
+// UDP has no connection to drain, the flows are dropped right away
+func (server *udpServer) Stop(ctx context.Context) error {
+	server.mu.Lock()
+	server.stopping.Store(true)
+	flows := make([]*udpFlow, 0, len(server.flows))
+	for _, flow := range server.flows {
+		flows = append(flows, flow)
+	}
+	server.mu.Unlock()
+
+	err := server.conn.Close()
+	for _, flow := range flows {
+		server.endFlow(flow, nil)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		server.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return errors.Join(err, ctx.Err())
+	}
+}
+
+// resolves the endpoint address for the flows created until the next health check
+func (endpoint *Endpoint) resolveUDP() error {
+	address, err := endpoint.hostPort()
+	if err != nil {
+		return err
+	}
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	endpoint.udpAddr.Store(addr)
+	return nil
+}
+
+// the probe is opt-in (type udp) as not every service tolerates an empty datagram. It
+// is sent through a connected socket, the refusal comes back as an error on the
+// following read. Without it the endpoint is up at every health check and only taken
+// down by the flows refused in between
+func (endpoint *Endpoint) udpHealthCheck(check *HealthCheck) error {
+	if check == nil || check.Type != HEALTH_CHECK_UDP {
+		return nil
+	}
+	conn, err := net.DialUDP("udp", nil, endpoint.udpAddr.Load())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(nil); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(udpHealthCheckWait))
+	if _, err := conn.Read(make([]byte, 1)); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// endpoint answering every datagram with its own content
+func udpEcho(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, client, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDPAddrPort(buf[:n], client)
+		}
+	}()
+	return conn
+}
+
+func udpBind(t *testing.T, layer4 *Layer4, addresses ...string) *Bind {
+	t.Helper()
+	group := rawGroup(t, PROTO_UDP, layer4, addresses...)
+	for _, endpoint := range group.Endpoints {
+		endpoint.network = PROTO_UDP
+		if err := endpoint.resolveUDP(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bind := &Bind{Address: "127.0.0.1:0", Groups: []*Group{group}, conf: group.conf}
+	if err := bind.startUDPServer(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bind.udp.Stop(context.Background()) })
+	return bind
+}
+
+func udpClient(t *testing.T, bind *Bind) *net.UDPConn {
+	t.Helper()
+	conn, err := net.DialUDP("udp", nil, bind.udp.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func (server *udpServer) flowCount() int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return len(server.flows)
+}
+
+func TestUDPFlows(t *testing.T) {
+	echo := udpEcho(t)
+	bind := udpBind(t, &Layer4{IdleTimeout: "200ms"}, "udp://"+echo.LocalAddr().String())
+	client := udpClient(t, bind)
+
+	buf := make([]byte, 64)
+	for _, payload := range []string{"first", "second"} {
+		if _, err := client.Write([]byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil || string(buf[:n]) != payload {
+			t.Fatalf("answer = %q, %v, want %q", buf[:n], err, payload)
+		}
+	}
+	if count := bind.udp.flowCount(); count != 1 {
+		t.Errorf("flows = %d, want a single flow per client", count)
+	}
+
+	if !waitFor(t, 5*time.Second, func() bool { return bind.udp.flowCount() == 0 }) {
+		t.Fatal("idle flow not expired")
+	}
+	if active := bind.Groups[0].Endpoints[0].ActiveConnections.Load(); active != 0 {
+		t.Errorf("active connections = %d after the flow expired", active)
+	}
+}
+
+func TestUDPMaxFlows(t *testing.T) {
+	echo := udpEcho(t)
+	bind := udpBind(t, &Layer4{MaxFlows: 1}, "udp://"+echo.LocalAddr().String())
+	first, second := udpClient(t, bind), udpClient(t, bind)
+
+	buf := make([]byte, 64)
+	first.Write([]byte("first"))
+	first.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := first.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	second.Write([]byte("second"))
+	second.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := second.Read(buf); err == nil {
+		t.Fatalf("datagram beyond maxFlows forwarded, answer %q", buf[:n])
+	}
+	if count := bind.udp.flowCount(); count != 1 {
+		t.Errorf("flows = %d, want 1", count)
+	}
+
+	var out bytes.Buffer
+	bind.conf.metrics.registry.write(&out)
+	if !strings.Contains(out.String(), `minibalancer_udp_datagrams_dropped_total{bind="127.0.0.1:0",reason="max_flows"} 1`) {
+		t.Errorf("dropped datagram not counted:\n%s", out.String())
+	}
+}
+
+func TestUDPMaxFlowsValidation(t *testing.T) {
+	group := &Group{Layer4: &Layer4{MaxFlows: -1}, raw: PROTO_UDP}
+	if err := group.initLayer4(); err == nil {
+		t.Error("negative maxFlows accepted")
+	}
+
+	for _, size := range []int{-1, maxDatagramSize + 1} {
+		group = &Group{Layer4: &Layer4{MaxDatagramSize: size}, raw: PROTO_UDP}
+		if err := group.initLayer4(); err == nil {
+			t.Errorf("maxDatagramSize %d accepted", size)
+		}
+	}
+
+	group = &Group{raw: PROTO_UDP}
+	if err := group.initLayer4(); err != nil || group.Layer4.maxFlows != DefaultUDPMaxFlows {
+		t.Errorf("maxFlows = %d, %v, want %d", group.Layer4.maxFlows, err, DefaultUDPMaxFlows)
+	}
+	if group.Layer4.maxDatagramSize != DefaultUDPMaxDatagramSize {
+		t.Errorf("maxDatagramSize = %d, want %d", group.Layer4.maxDatagramSize, DefaultUDPMaxDatagramSize)
+	}
+}
+
+func TestUDPMaxDatagramSize(t *testing.T) {
+	echo := udpEcho(t)
+	bind := udpBind(t, &Layer4{MaxDatagramSize: 4}, "udp://"+echo.LocalAddr().String())
+	client := udpClient(t, bind)
+
+	client.Write([]byte("truncated"))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "trun" {
+		t.Errorf("answer = %q, want the first 4 bytes", buf[:n])
+	}
+}
+
+func TestUDPDialErrorKeepsEndpoint(t *testing.T) {
+	//a link-local address without zone cannot be connected, the socket fails locally
+	bind := udpBind(t, nil, "udp://[fe80::1]:53")
+	client := udpClient(t, bind)
+	client.Write([]byte("dropped"))
+
+	dropped := `minibalancer_udp_datagrams_dropped_total{bind="127.0.0.1:0",reason="dial_error"} 1`
+	counted := waitFor(t, 5*time.Second, func() bool {
+		var out bytes.Buffer
+		bind.conf.metrics.registry.write(&out)
+		return strings.Contains(out.String(), dropped)
+	})
+	if !counted {
+		t.Fatal("datagram not dropped as a dial error")
+	}
+	if !bind.Groups[0].Endpoints[0].Alive.Load() {
+		t.Error("local socket error took the endpoint down")
+	}
+}
+
+func TestUDPHealthCheckOptIn(t *testing.T) {
+	//nothing listens on the port of a closed socket, the probe is refused
+	closed, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := "udp://" + closed.LocalAddr().String()
+	closed.Close()
+
+	endpoint := &Endpoint{Address: address, network: PROTO_UDP}
+	endpoint.HealthCheck()
+	if !endpoint.Alive.Load() {
+		t.Error("endpoint down without a udp probe")
+	}
+	if endpoint.udpAddr.Load() == nil {
+		t.Error("endpoint address not resolved by the health check")
+	}
+
+	endpoint.healthCheck = &HealthCheck{Type: HEALTH_CHECK_UDP}
+	endpoint.HealthCheck()
+	if endpoint.Alive.Load() {
+		t.Error("refused udp probe left the endpoint up")
+	}
+
+	echo := udpEcho(t)
+	endpoint = &Endpoint{Address: "udp://" + echo.LocalAddr().String(), network: PROTO_UDP, healthCheck: &HealthCheck{Type: HEALTH_CHECK_UDP}}
+	endpoint.HealthCheck()
+	if !endpoint.Alive.Load() {
+		t.Error("answering endpoint down")
+	}
+}
@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultUpgradeIdleTimeout time.Duration = 10 * time.Minute
+
+// connections switching protocol (WebSocket and any other HTTP Upgrade), they outlive
+// the request so the bind timeouts do not apply to them
+type Upgrade struct {
+	//the connection is closed when no byte flows in either direction for this long
+	IdleTimeout string `json:"idleTimeout,omitempty"`
+	//upgraded connections open at the same time in the group, 0 means unlimited
+	MaxConnections int `json:"maxConnections,omitempty"`
+}
+
+func (group *Group) initUpgrade() {
+	group.upgradeIdleTimeout = DefaultUpgradeIdleTimeout
+	if group.Upgrade != nil {
+		group.upgradeIdleTimeout = getWithDefaultDuration(group.Upgrade.IdleTimeout, DefaultUpgradeIdleTimeout)
+		group.maxUpgrades = int64(group.Upgrade.MaxConnections)
+	}
+}
+
+// label of the group in metrics
+func (group *Group) metricsName() string {
+	return group.Address + group.Path
+}
+
+func isUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// takes a slot among the upgraded connections of the group, retries on another
+// endpoint keep the slot of the first attempt
+func (group *Group) acquireUpgrade(r *http.Request) bool {
+	if group.maxUpgrades == 0 || getRetryFromContext(RETRY_ANOTHER_ENDP, r) > 0 {
+		return true
+	}
+
+	if group.upgrades.Add(1) > group.maxUpgrades {
+		group.upgrades.Add(-1)
+		group.conf.metrics.upgradesRejectedTotal.with(group.metricsName()).inc()
+		return false
+	}
+	return true
+}
+
+func (group *Group) releaseUpgrade(r *http.Request) {
+	if group.maxUpgrades != 0 && getRetryFromContext(RETRY_ANOTHER_ENDP, r) == 0 {
+		group.upgrades.Add(-1)
+	}
+}
+
+// the reverse proxy blocks until the upgraded connection is closed, so the endpoint
+// keeps counting it in ActiveConnections. Latency and outlier statistics are not
+// sampled, the duration of a socket says nothing about the endpoint health
+func (group *Group) serveUpgrade(w http.ResponseWriter, r *http.Request, endpoint *Endpoint) {
+	endpoint.ActiveConnections.Add(1)
+	defer endpoint.ActiveConnections.Add(^uint64(0))
+
+	uw := &upgradeWriter{ResponseWriter: w, group: group, endpoint: endpoint}
+	endpoint.ReverseProxy.ServeHTTP(uw, r)
+}
+
+// hands the hijacked client connection to the reverse proxy wrapped with the idle timeout
+type upgradeWriter struct {
+	http.ResponseWriter
+	group    *Group
+	endpoint *Endpoint
+}
+
+func (uw *upgradeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(uw.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	groupName := uw.group.metricsName()
+	metrics := uw.group.conf.metrics
+	open := metrics.upgradedConnections.with(groupName, uw.endpoint.Address)
+	open.inc()
+	metrics.upgradedConnectionsTotal.with(groupName, uw.endpoint.Address).inc()
+	start := time.Now()
+
+	idle := &idleConn{Conn: conn, timeout: uw.group.upgradeIdleTimeout}
+	idle.touch()
+	idle.onClose = func() {
+		open.dec()
+		metrics.upgradedConnectionDuration.with(groupName).observe(time.Since(start).Seconds())
+	}
+	return idle, brw, nil
+}
+
+func (uw *upgradeWriter) Unwrap() http.ResponseWriter {
+	return uw.ResponseWriter
+}
+
+// replaces the deadlines left by the server with an idle timeout covering both directions:
+// a read deadline expiring while the other direction is active is pushed forward
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+	//unix nano time of the last byte read or written
+	lastActivity atomic.Int64
+	closeOnce    sync.Once
+	onClose      func()
+}
+
+func (c *idleConn) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (c *idleConn) idleFor() time.Duration {
+	return time.Duration(time.Now().UnixNano() - c.lastActivity.Load())
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout - c.idleFor()))
+		n, err := c.Conn.Read(p)
+		if n > 0 {
+			c.touch()
+		}
+		if n == 0 && errors.Is(err, os.ErrDeadlineExceeded) && c.idleFor() < c.timeout {
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *idleConn) Close() error {
+	err := c.Conn.Close()
+	if c.onClose != nil {
+		c.closeOnce.Do(c.onClose)
+	}
+	return err
+}
+
+// half close of raw connections, see splice
+func (c *idleConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
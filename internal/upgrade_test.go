@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// endpoint switching to an echo protocol on every upgrade request
+func echoUpgradeServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUpgradeRequest(r) {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// upgraded connection through the bind, nil with the response when the upgrade is refused
+func dialUpgrade(t *testing.T, address string) (net.Conn, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, resp
+	}
+	if reader.Buffered() != 0 {
+		t.Fatal("bytes after the upgrade response")
+	}
+	return conn, resp
+}
+
+func TestUpgradeIdleTimeout(t *testing.T) {
+	backend := echoUpgradeServer(t)
+	//shorter than the idle timeout, the bind write timeout must not apply
+	conf := startTestConf(t, testBindConf(`"writeTimout": "100ms",`, `"upgrade": {"idleTimeout": "300ms"},`, backend.URL))
+
+	conn, resp := dialUpgrade(t, conf.Settings.Bind[0].listenAddr())
+	if conn == nil {
+		t.Fatalf("upgrade answered %s", resp.Status)
+	}
+
+	//traffic keeps the connection open past the write timeout
+	buf := make([]byte, 4)
+	for range 4 {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("echo = %q, %v", buf, err)
+		}
+	}
+
+	start := time.Now()
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("idle connection not closed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("idle connection closed after %v", elapsed)
+	}
+}
+
+func TestUpgradeMaxConnections(t *testing.T) {
+	backend := echoUpgradeServer(t)
+	conf := startTestConf(t, testBindConf("", `"upgrade": {"maxConnections": 1},`, backend.URL))
+	address := conf.Settings.Bind[0].listenAddr()
+
+	first, resp := dialUpgrade(t, address)
+	if first == nil {
+		t.Fatalf("first upgrade answered %s", resp.Status)
+	}
+	if second, resp := dialUpgrade(t, address); second != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("upgrade beyond the limit answered %s", resp.Status)
+	}
+
+	first.Close()
+	group := conf.Settings.Bind[0].Groups[0]
+	for deadline := time.Now().Add(5 * time.Second); group.upgrades.Load() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("closed upgraded connection still counted")
+		}
+	}
+	if third, resp := dialUpgrade(t, address); third == nil {
+		t.Errorf("upgrade after a close answered %s", resp.Status)
+	}
+}
+
+func TestIsUpgradeRequest(t *testing.T) {
+	tests := []struct {
+		connection string
+		upgrade    string
+		want       bool
+	}{
+		{"Upgrade", "websocket", true},
+		{"keep-alive, upgrade", "websocket", true},
+		{"keep-alive", "websocket", false},
+		{"Upgrade", "", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Connection", test.connection)
+		r.Header.Set("Upgrade", test.upgrade)
+		if got := isUpgradeRequest(r); got != test.want {
+			t.Errorf("Connection %q, Upgrade %q: %v, want %v", test.connection, test.upgrade, got, test.want)
+		}
+	}
+}
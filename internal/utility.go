@@ -1,6 +1,10 @@
 package internal
 
-import "log/slog"
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
 
 func catchUnwind(fn func()) bool {
 	panicked := false
@@ -13,3 +17,38 @@ func catchUnwind(fn func()) bool {
 	fn()
 	return panicked
 }
+
+// keeps track of the response status written by the reverse proxy
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	//time the response headers were written
+	headerAt time.Time
+	//set by the proxy error handler when the endpoint could not be reached
+	failed bool
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+		rec.headerAt = time.Now()
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+		rec.headerAt = time.Now()
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// used by http.ResponseController to reach Flush, Hijack and deadlines
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func (rec *statusRecorder) success() bool {
+	return !rec.failed && rec.status < http.StatusInternalServerError
+}
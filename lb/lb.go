@@ -0,0 +1,134 @@
+// Package lb runs minibalancer inside another Go program.
+//
+// Every LoadBalancer owns its configuration and state, so several independent
+// instances can run in the same process. The only process wide resource is the
+// logger: when the configuration has a "global.logger" section, starting the
+// instance replaces the default slog and log outputs.
+package lb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"minibalancer/internal"
+)
+
+// Config is a parsed configuration, in the format of the JSON configuration file.
+// It is only built by LoadConfig and ParseConfig.
+type Config struct {
+	conf *internal.Conf
+}
+
+// LoadConfig reads a JSON configuration file, relative file names (certificates,
+// error pages) are resolved from the file directory unless basePath is set.
+func LoadConfig(path string) (*Config, error) {
+	conf, err := internal.LoadConf(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Config{conf: conf}, nil
+}
+
+// ParseConfig parses a JSON configuration, relative file names are resolved from basePath.
+func ParseConfig(data []byte, basePath string) (*Config, error) {
+	conf, err := internal.ParseConf(data, basePath)
+	if err != nil {
+		return nil, err
+	}
+	return &Config{conf: conf}, nil
+}
+
+type LoadBalancer struct {
+	mu      sync.Mutex
+	conf    *internal.Conf
+	started bool
+	stopped bool
+}
+
+// New creates a stopped balancer, conf must not be shared with other instances.
+func New(conf *Config) (*LoadBalancer, error) {
+	if conf == nil || conf.conf == nil || conf.conf.Settings == nil {
+		return nil, errors.New("lb: missing settings in configuration")
+	}
+	return &LoadBalancer{conf: conf.conf}, nil
+}
+
+// Start starts health checks and listeners, it returns once they are started.
+// A LoadBalancer can be started only once.
+func (lb *LoadBalancer) Start(ctx context.Context) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if lb.started {
+		return errors.New("lb: already started")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	lb.started = true
+	if err := lb.conf.Start(); err != nil {
+		lb.stopped = true
+		//releasing whatever was started before the failure
+		lb.conf.Stop(context.WithoutCancel(ctx))
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops listeners waiting for in flight requests until ctx is done,
+// then stops health checks and background tasks.
+func (lb *LoadBalancer) Shutdown(ctx context.Context) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if !lb.started || lb.stopped {
+		return nil
+	}
+
+	lb.stopped = true
+	return lb.conf.Stop(ctx)
+}
+
+// Drain stops sending new requests and new sticky sessions to the endpoints with
+// this address, in every group. Sticky sessions already assigned are served until
+// the endpoint is idle or its drainTimeout expires. A configuration reload (SIGHUP)
+// applies the draining flags of the file again.
+func (lb *LoadBalancer) Drain(address string) error {
+	endpoints, err := lb.endpoints(address)
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range endpoints {
+		endpoint.Drain()
+	}
+	return nil
+}
+
+// Undrain puts back in rotation the endpoints with this address.
+func (lb *LoadBalancer) Undrain(address string) error {
+	endpoints, err := lb.endpoints(address)
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range endpoints {
+		endpoint.Undrain()
+	}
+	return nil
+}
+
+func (lb *LoadBalancer) endpoints(address string) ([]*internal.Endpoint, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if !lb.started || lb.stopped {
+		return nil, errors.New("lb: not running")
+	}
+	endpoints := lb.conf.Settings.FindEndpoints(address)
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("lb: no endpoint with address %q", address)
+	}
+	return endpoints, nil
+}
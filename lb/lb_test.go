@@ -0,0 +1,105 @@
+package lb
+
+import (
+	"context"
+	"testing"
+)
+
+const testConfig = `{
+	"settings": {
+		"bindings": [{
+			"address": "127.0.0.1:0",
+			"groups": [{"path": "/", "endpoints": [{"address": "http://127.0.0.1:1"}]}]
+		}]
+	}
+}`
+
+func TestLifecycle(t *testing.T) {
+	ctx := context.Background()
+
+	for _, conf := range []*Config{nil, {}} {
+		if _, err := New(conf); err == nil {
+			t.Errorf("New accepted the configuration %v", conf)
+		}
+	}
+	if conf, err := ParseConfig([]byte("{"), t.TempDir()); err == nil || conf != nil {
+		t.Errorf("invalid JSON parsed: %v, %v", conf, err)
+	}
+
+	//two instances in the same process
+	for range 2 {
+		conf, err := ParseConfig([]byte(testConfig), t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		balancer, err := New(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := balancer.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown before Start: %v", err)
+		}
+		if err := balancer.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := balancer.Start(ctx); err == nil {
+			t.Error("a balancer was started twice")
+		}
+		if err := balancer.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+		if err := balancer.Shutdown(ctx); err != nil {
+			t.Errorf("second Shutdown: %v", err)
+		}
+	}
+}
+
+func TestStartCanceled(t *testing.T) {
+	conf, err := ParseConfig([]byte(testConfig), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	balancer, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := balancer.Start(ctx); err == nil {
+		t.Error("Start with a canceled context succeeded")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	ctx := context.Background()
+	conf, err := ParseConfig([]byte(testConfig), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	balancer, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const address = "http://127.0.0.1:1"
+	if err := balancer.Drain(address); err == nil {
+		t.Error("endpoint drained before Start")
+	}
+	if err := balancer.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer balancer.Shutdown(ctx)
+
+	endpoint := balancer.conf.Settings.Bind[0].Groups[0].Endpoints[0]
+	if err := balancer.Drain(address); err != nil || !endpoint.IsDraining() {
+		t.Errorf("endpoint not draining: %v", err)
+	}
+	if err := balancer.Undrain(address); err != nil || endpoint.IsDraining() {
+		t.Errorf("endpoint still draining: %v", err)
+	}
+	if err := balancer.Drain("http://unknown"); err == nil {
+		t.Error("unknown endpoint drained")
+	}
+}